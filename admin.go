@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// adminTokenEnv is the environment variable that the admin API token is read
+// from when --admin-token-file isn't set.
+const adminTokenEnv = "CAS_PROXY_ADMIN_TOKEN"
+
+// loadSecret reads a secret from the file, or from the environment variable if
+// the file isn't set. An empty secret is returned if neither has one.
+func loadSecret(file, env string) ([]byte, error) {
+	var secret string
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", file)
+		}
+		secret = string(b)
+	} else {
+		secret = os.Getenv(env)
+	}
+	return []byte(strings.TrimSpace(secret)), nil
+}
+
+// loadAdminToken reads the token that admin API requests must present.
+func loadAdminToken(file string) ([]byte, error) {
+	token, err := loadSecret(file, adminTokenEnv)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read admin token file")
+	}
+	if len(token) == 0 {
+		return nil, errors.New("the admin API requires a token in --admin-token-file or $" + adminTokenEnv)
+	}
+	return token, nil
+}
+
+// sessionHandle returns the ID that the admin API uses for the session. The
+// session ID itself isn't exposed, since it's what the backend stores the
+// session under.
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sessionInfo describes a session in the admin API.
+type sessionInfo struct {
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	Login      *time.Time `json:"login,omitempty"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+	ClientIP   string     `json:"client_ip,omitempty"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+	Websockets int        `json:"websockets"`
+}
+
+// AdminAPI lists and revokes the sessions in a server-side session store and
+// flushes the permission decision cache. It's served on its own listener, and
+// every request must have the admin token as a bearer token.
+type AdminAPI struct {
+	token     []byte
+	sessions  *serverStore // Nil if sessions are only kept in cookies.
+	conns     *connTracker
+	decisions *decisionCache // Nil if decisions aren't cached.
+}
+
+// NewAdminAPI returns a newly instantiated *AdminAPI.
+func NewAdminAPI(token []byte, sessions *serverStore, conns *connTracker, decisions *decisionCache) *AdminAPI {
+	return &AdminAPI{
+		token:     token,
+		sessions:  sessions,
+		conns:     conns,
+		decisions: decisions,
+	}
+}
+
+// Handler returns the handler for the admin API's routes.
+func (a *AdminAPI) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Path("/sessions").Methods(http.MethodGet).HandlerFunc(a.needsSessions(a.ListSessions))
+	r.Path("/sessions/{id}").Methods(http.MethodDelete).HandlerFunc(a.needsSessions(a.RevokeSession))
+	r.Path("/users/{username}/sessions").Methods(http.MethodDelete).HandlerFunc(a.needsSessions(a.RevokeUser))
+	r.Path("/decisions").Methods(http.MethodDelete).HandlerFunc(a.FlushDecisions)
+	return a.authenticate(r)
+}
+
+// needsSessions responds with an error instead of calling the handler if the
+// sessions are only kept in cookies, since there's no way to list them.
+func (a *AdminAPI) needsSessions(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.sessions == nil {
+			http.Error(w, "sessions can only be listed and revoked with a server-side session backend", http.StatusNotImplemented)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// FlushDecisions removes cached permission decisions, so that the permissions
+// service is asked again on the next request. The username query parameter
+// limits it to one user's decisions.
+func (a *AdminAPI) FlushDecisions(w http.ResponseWriter, r *http.Request) {
+	n := 0
+	if a.decisions != nil {
+		n = a.decisions.Flush(r.URL.Query().Get("username"))
+	}
+	log.Infof("flushed %d cached permission decisions", n)
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+// authenticate rejects requests that don't have the admin token.
+func (a *AdminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cas-proxy-admin"`)
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// info returns the description of the session with the ID.
+func (a *AdminAPI) info(id string, values map[interface{}]interface{}) sessionInfo {
+	info := sessionInfo{
+		ID:         sessionHandle(id),
+		Websockets: a.conns.CountSession(id),
+	}
+	info.Username, _ = values[sessionKey].(string)
+	info.ClientIP, _ = values[sessionClientIP].(string)
+	info.UserAgent, _ = values[sessionUserAgent].(string)
+	if v, ok := values[sessionLogin].(int64); ok {
+		t := time.Unix(v, 0).UTC()
+		info.Login = &t
+	}
+	if v, ok := values[sessionAccess].(int64); ok {
+		t := time.Unix(v, 0).UTC()
+		info.LastAccess = &t
+	}
+	return info
+}
+
+// each calls fn with the ID and values of every logged-in session. Sessions
+// that expire while they're being listed are skipped.
+func (a *AdminAPI) each(fn func(id string, values map[interface{}]interface{})) error {
+	ids, err := a.sessions.backend.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list sessions")
+	}
+
+	for _, id := range ids {
+		values, err := a.sessions.load(id)
+		if err == errSessionNotFound {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to load session %s", sessionHandle(id))
+		}
+		if _, ok := values[sessionKey].(string); ok {
+			fn(id, values)
+		}
+	}
+	return nil
+}
+
+// ListSessions writes out the logged-in sessions as a JSON array. The username
+// query parameter limits the list to one user's sessions.
+func (a *AdminAPI) ListSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+
+	list := []sessionInfo{}
+	err := a.each(func(id string, values map[interface{}]interface{}) {
+		info := a.info(id, values)
+		if username == "" || info.Username == username {
+			list = append(list, info)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, list)
+}
+
+// RevokeSession deletes the session and closes its websocket connections.
+func (a *AdminAPI) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	handle := mux.Vars(r)["id"]
+
+	var found *sessionInfo
+	err := a.each(func(id string, values map[interface{}]interface{}) {
+		if found == nil && sessionHandle(id) == handle {
+			info := a.info(id, values)
+			found = &info
+			if err := a.revoke(id); err != nil {
+				log.Error(err)
+				found = nil
+			}
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	log.Infof("revoked session %s for %s", found.ID, found.Username)
+	writeJSON(w, found)
+}
+
+// RevokeUser deletes all of the user's sessions and closes their websocket
+// connections, including the ones opened without a session.
+func (a *AdminAPI) RevokeUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	revoked := []sessionInfo{}
+	var revokeErr error
+	err := a.each(func(id string, values map[interface{}]interface{}) {
+		info := a.info(id, values)
+		if info.Username != username {
+			return
+		}
+		if err := a.revoke(id); err != nil {
+			revokeErr = err
+			return
+		}
+		revoked = append(revoked, info)
+	})
+	if err == nil {
+		err = revokeErr
+	}
+	a.conns.CloseUser(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("revoked %d sessions for %s", len(revoked), username)
+	writeJSON(w, revoked)
+}
+
+// revoke deletes the session from the backend and closes its websocket
+// connections.
+func (a *AdminAPI) revoke(id string) error {
+	if err := a.sessions.backend.Delete(id); err != nil {
+		return errors.Wrapf(err, "failed to delete session %s", sessionHandle(id))
+	}
+	a.conns.CloseSession(id)
+	return nil
+}
+
+// writeJSON writes out the value as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
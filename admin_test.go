@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin secret"
+
+// loginTestSession stores a logged-in session for the user, and returns its
+// ID.
+func loginTestSession(t *testing.T, store *serverStore, username string) string {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.New(r, "proxy-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Regenerate(session); err != nil {
+		t.Fatal(err)
+	}
+	session.Values[sessionKey] = username
+	session.Values[sessionLogin] = time.Now().Unix()
+	if err = session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	return session.ID
+}
+
+// openTestWebsocket tracks an upgraded websocket connection for the session
+// and user, and returns it.
+func openTestWebsocket(t *testing.T, tracker *connTracker, sessionID, username string) *trackedConn {
+	client, server := net.Pipe()
+	go ioutil.ReadAll(client)
+	conn := &trackedConn{Conn: server, tracker: tracker, sessionID: sessionID, username: username}
+	conn.frames.upgraded = true
+	tracker.add(conn)
+	return conn
+}
+
+// isOpen returns true if the tracker still has the connection.
+func isOpen(tracker *connTracker, conn *trackedConn) bool {
+	return len(tracker.matching(func(c *trackedConn) bool { return c == conn })) == 1
+}
+
+// adminRequest sends the request to the admin API with the token, and returns
+// the response.
+func adminRequest(a *AdminAPI, method, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAPIAuthentication(t *testing.T) {
+	a := NewAdminAPI([]byte(testAdminToken), newTestServerStore(newMemoryBackend()), newConnTracker(), newDecisionCache(time.Minute, time.Minute, 10))
+
+	routes := []struct{ method, target string }{
+		{http.MethodGet, "/sessions"},
+		{http.MethodDelete, "/sessions/abc"},
+		{http.MethodDelete, "/users/alice/sessions"},
+		{http.MethodDelete, "/decisions"},
+		{http.MethodGet, "/unknown"},
+	}
+
+	for _, route := range routes {
+		for _, token := range []string{"", "admin", testAdminToken + "x"} {
+			w := adminRequest(a, route.method, route.target, token)
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s with %q: expected 401 with a challenge, got %d", route.method, route.target, token, w.Code)
+			}
+		}
+
+		// Basic credentials with the token as the password aren't accepted
+		// either.
+		r := httptest.NewRequest(route.method, route.target, nil)
+		r.SetBasicAuth("admin", testAdminToken)
+		w := httptest.NewRecorder()
+		a.Handler().ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s with Basic credentials: expected 401, got %d", route.method, route.target, w.Code)
+		}
+
+		if w := adminRequest(a, route.method, route.target, testAdminToken); w.Code == http.StatusUnauthorized {
+			t.Errorf("%s %s: expected the token to be accepted", route.method, route.target)
+		}
+	}
+}
+
+func TestAdminAPISessions(t *testing.T) {
+	store := newTestServerStore(newMemoryBackend())
+	tracker := newConnTracker()
+	a := NewAdminAPI([]byte(testAdminToken), store, tracker, nil)
+
+	alice := loginTestSession(t, store, "alice")
+	bob := loginTestSession(t, store, "bob")
+	aliceConn := openTestWebsocket(t, tracker, alice, "alice")
+	bobConn := openTestWebsocket(t, tracker, bob, "bob")
+
+	w := adminRequest(a, http.MethodGet, "/sessions?username=alice", testAdminToken)
+	list := []sessionInfo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != sessionHandle(alice) || list[0].Websockets != 1 || list[0].Login == nil {
+		t.Fatalf("expected alice's session with one websocket, got %+v", list)
+	}
+	if list[0].ID == alice {
+		t.Error("expected the session ID not to be exposed")
+	}
+
+	// Unknown sessions, including ones named by their real IDs, aren't found.
+	for _, id := range []string{"0123456789abcdef", alice} {
+		if w = adminRequest(a, http.MethodDelete, "/sessions/"+id, testAdminToken); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for an unknown session, got %d", w.Code)
+		}
+	}
+	if !isOpen(tracker, aliceConn) {
+		t.Error("expected alice's websocket to stay open")
+	}
+
+	if w = adminRequest(a, http.MethodDelete, "/sessions/"+sessionHandle(alice), testAdminToken); w.Code != http.StatusOK {
+		t.Fatalf("expected alice's session to be revoked, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := store.load(alice); err != errSessionNotFound {
+		t.Errorf("expected alice's session to be deleted, got %v", err)
+	}
+	if isOpen(tracker, aliceConn) || !isOpen(tracker, bobConn) {
+		t.Error("expected only alice's websocket to be closed")
+	}
+
+	// Revoking it again doesn't find it.
+	if w = adminRequest(a, http.MethodDelete, "/sessions/"+sessionHandle(alice), testAdminToken); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a revoked session, got %d", w.Code)
+	}
+}
+
+func TestAdminAPIRevokeUser(t *testing.T) {
+	store := newTestServerStore(newMemoryBackend())
+	tracker := newConnTracker()
+	a := NewAdminAPI([]byte(testAdminToken), store, tracker, nil)
+
+	first := loginTestSession(t, store, "alice")
+	second := loginTestSession(t, store, "alice")
+	bob := loginTestSession(t, store, "bob")
+	conns := []*trackedConn{
+		openTestWebsocket(t, tracker, first, "alice"),
+		openTestWebsocket(t, tracker, second, "alice"),
+		openTestWebsocket(t, tracker, "", "alice"), // Opened with a bearer token.
+	}
+	bobConn := openTestWebsocket(t, tracker, bob, "bob")
+
+	w := adminRequest(a, http.MethodDelete, "/users/alice/sessions", testAdminToken)
+	revoked := []sessionInfo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &revoked); err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 {
+		t.Errorf("expected both of alice's sessions to be revoked, got %+v", revoked)
+	}
+
+	for _, id := range []string{first, second} {
+		if _, err := store.load(id); err != errSessionNotFound {
+			t.Errorf("expected alice's session to be deleted, got %v", err)
+		}
+	}
+	for i, conn := range conns {
+		if isOpen(tracker, conn) {
+			t.Errorf("expected alice's websocket %d to be closed", i)
+		}
+	}
+	if _, err := store.load(bob); err != nil || !isOpen(tracker, bobConn) {
+		t.Errorf("expected bob's session and websocket to be kept, got %v", err)
+	}
+
+	// A user without sessions has nothing revoked.
+	w = adminRequest(a, http.MethodDelete, "/users/carol/sessions", testAdminToken)
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("expected an empty list, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminAPIWithoutServerSessions(t *testing.T) {
+	a := NewAdminAPI([]byte(testAdminToken), nil, newConnTracker(), nil)
+
+	for _, target := range []string{"/sessions", "/sessions/abc", "/users/alice/sessions"} {
+		method := http.MethodDelete
+		if target == "/sessions" {
+			method = http.MethodGet
+		}
+		if w := adminRequest(a, method, target, testAdminToken); w.Code != http.StatusNotImplemented {
+			t.Errorf("%s %s: expected 501, got %d", method, target, w.Code)
+		}
+	}
+
+	// Decisions can be flushed even if they aren't cached.
+	if w := adminRequest(a, http.MethodDelete, "/decisions", testAdminToken); w.Code != http.StatusOK {
+		t.Errorf("expected flushing decisions to succeed, got %d", w.Code)
+	}
+}
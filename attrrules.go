@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultEmailAttribute is the attribute that email domain rules look at,
+// unless the rule says otherwise.
+const defaultEmailAttribute = "mail"
+
+// defaultRuleLevel is the permission level that any-of rules grant, unless the
+// rule says otherwise.
+const defaultRuleLevel = "read"
+
+// How attribute rules are combined with the decision of the authorizer that
+// they wrap.
+const (
+	combineAllOf = "all-of"
+	combineAnyOf = "any-of"
+)
+
+// attributeRule matches users who have any of the values for the attribute,
+// or whose email addresses are in any of the domains. Email domains also
+// match their subdomains, and are compared without regard to case. Any-of
+// rules grant the users they match a permission level.
+type attributeRule struct {
+	Combine      string   `json:"combine"`
+	Attribute    string   `json:"attribute"`
+	Values       []string `json:"values"`
+	EmailDomains []string `json:"email_domains"`
+	Level        string   `json:"level"`
+}
+
+// String describes the rule for denial reasons.
+func (r *attributeRule) String() string {
+	if len(r.EmailDomains) > 0 {
+		return fmt.Sprintf("an email address at %s in %s", strings.Join(r.EmailDomains, ", "), r.Attribute)
+	}
+	return fmt.Sprintf("one of these values of %s: %s", r.Attribute, strings.Join(r.Values, ", "))
+}
+
+func (r *attributeRule) matches(attributes map[string][]string) bool {
+	for _, v := range attributes[r.Attribute] {
+		for _, want := range r.Values {
+			if v == want {
+				return true
+			}
+		}
+
+		at := strings.LastIndex(v, "@")
+		if at < 0 {
+			continue
+		}
+		domain := strings.ToLower(v[at+1:])
+		for _, want := range r.EmailDomains {
+			want = strings.ToLower(want)
+			if domain == want || strings.HasSuffix(domain, "."+want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadAttributeRules reads the rules from a JSON file with an array of them,
+// such as:
+//
+//	[
+//	  {"combine": "all-of", "attribute": "memberOf", "values": ["bio101-section2"]},
+//	  {"combine": "any-of", "attribute": "eduPersonAffiliation", "values": ["faculty"], "level": "write"},
+//	  {"combine": "any-of", "email_domains": ["example.edu"]}
+//	]
+func loadAttributeRules(file string) ([]*attributeRule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read attribute rules %s", file)
+	}
+
+	rules := []*attributeRule{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err = d.Decode(&rules); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse attribute rules %s", file)
+	}
+
+	for i, rule := range rules {
+		if rule.Combine != combineAllOf && rule.Combine != combineAnyOf {
+			return nil, fmt.Errorf("rule %d in %s must combine with all-of or any-of, not %q", i+1, file, rule.Combine)
+		}
+		if rule.Attribute == "" && len(rule.EmailDomains) > 0 {
+			rule.Attribute = defaultEmailAttribute
+		}
+		if rule.Attribute == "" {
+			return nil, fmt.Errorf("rule %d in %s doesn't have an attribute", i+1, file)
+		}
+		if len(rule.Values) == 0 && len(rule.EmailDomains) == 0 {
+			return nil, fmt.Errorf("rule %d in %s doesn't have any values or email domains", i+1, file)
+		}
+		if rule.Combine == combineAllOf && rule.Level != "" {
+			return nil, fmt.Errorf("rule %d in %s is all-of, so it can't grant a level", i+1, file)
+		}
+		if rule.Combine == combineAnyOf && rule.Level == "" {
+			rule.Level = defaultRuleLevel
+		}
+		if rule.Level != "" && levelRank(rule.Level) < 0 {
+			return nil, fmt.Errorf("rule %d in %s has an unknown level %s. Must be one of: %s", i+1, file, rule.Level, strings.Join(permissionLevels, ", "))
+		}
+	}
+	return rules, nil
+}
+
+// AttributeAuthorizer is an Authorizer that combines rules about the
+// attributes released by the provider with the decision of another
+// Authorizer. Users must match every all-of rule. Users who match an any-of
+// rule have at least the rule's permission level, so they're allowed the
+// requests that the access policy allows that level, unless the other
+// Authorizer explicitly denies them. Everyone else is allowed if the other
+// Authorizer allows them.
+type AttributeAuthorizer struct {
+	next   Authorizer
+	policy accessPolicy // What the granted levels allow. Nil if any level allows everything.
+	allOf  []*attributeRule
+	anyOf  []*attributeRule
+}
+
+// NewAttributeAuthorizer returns a newly instantiated *AttributeAuthorizer that
+// wraps next. The policy is optional.
+func NewAttributeAuthorizer(next Authorizer, policy accessPolicy, rules []*attributeRule) *AttributeAuthorizer {
+	a := &AttributeAuthorizer{next: next, policy: policy}
+	for _, rule := range rules {
+		if rule.Combine == combineAllOf {
+			a.allOf = append(a.allOf, rule)
+		} else {
+			a.anyOf = append(a.anyOf, rule)
+		}
+	}
+	return a
+}
+
+// Authorize applies the all-of rules, and then asks the wrapped Authorizer.
+// If it doesn't allow the request, but doesn't explicitly deny it either, the
+// highest level granted by the any-of rules that match decides it.
+func (a *AttributeAuthorizer) Authorize(req *AccessRequest) (*Decision, error) {
+	for _, rule := range a.allOf {
+		if !rule.matches(req.Attributes) {
+			return deny("%s must have %s", req.Username, rule), nil
+		}
+	}
+
+	decision, err := a.next.Authorize(req)
+	if err != nil || decision.Allowed || decision.Explicit {
+		return decision, err
+	}
+
+	levels := []string{}
+	for _, rule := range a.anyOf {
+		if rule.matches(req.Attributes) {
+			levels = append(levels, rule.Level)
+		}
+	}
+	if len(levels) == 0 {
+		return decision, nil
+	}
+	return a.policy.Decide(req, highestLevel(levels)), nil
+}
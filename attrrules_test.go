@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubAuthorizer returns the same decision for every request, and counts
+// them.
+type stubAuthorizer struct {
+	decision *Decision
+	calls    int
+}
+
+func (s *stubAuthorizer) Authorize(req *AccessRequest) (*Decision, error) {
+	s.calls++
+	return s.decision, nil
+}
+
+func TestLoadAttributeRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{"valid", `[{"combine": "all-of", "attribute": "memberOf", "values": ["bio101"]}, {"combine": "any-of", "email_domains": ["example.edu"]}]`, ""},
+		{"unknown combine", `[{"combine": "some-of", "attribute": "memberOf", "values": ["bio101"]}]`, "must combine with all-of or any-of"},
+		{"missing combine", `[{"attribute": "memberOf", "values": ["bio101"]}]`, "must combine with all-of or any-of"},
+		{"missing attribute", `[{"combine": "any-of", "values": ["faculty"]}]`, "doesn't have an attribute"},
+		{"no values", `[{"combine": "any-of", "attribute": "memberOf"}]`, "doesn't have any values or email domains"},
+		{"all-of with a level", `[{"combine": "all-of", "attribute": "memberOf", "values": ["bio101"], "level": "write"}]`, "can't grant a level"},
+		{"unknown level", `[{"combine": "any-of", "attribute": "memberOf", "values": ["bio101"], "level": "superuser"}]`, "unknown level superuser"},
+		{"second rule", `[{"combine": "any-of", "attribute": "memberOf", "values": ["bio101"]}, {"combine": "any-of"}]`, "rule 2 in"},
+		{"unknown field", `[{"combine": "any-of", "attribute": "memberOf", "value": ["bio101"]}]`, "failed to parse"},
+		{"not JSON", `any-of memberOf bio101`, "failed to parse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "rules.json")
+			if err := ioutil.WriteFile(file, []byte(test.rules), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := loadAttributeRules(file)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Email domain rules default to the mail attribute, and any-of rules
+			// to the read level.
+			if rules[0].Level != "" || rules[1].Attribute != defaultEmailAttribute || rules[1].Level != defaultRuleLevel {
+				t.Errorf("expected the defaults to be filled in, got %+v and %+v", rules[0], rules[1])
+			}
+		})
+	}
+
+	if _, err := loadAttributeRules(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected a missing file to be an error")
+	}
+}
+
+func TestAttributeRuleMatches(t *testing.T) {
+	values := &attributeRule{Attribute: "memberOf", Values: []string{"bio101"}}
+	domains := &attributeRule{Attribute: "mail", EmailDomains: []string{"Example.EDU"}}
+
+	tests := []struct {
+		name       string
+		rule       *attributeRule
+		attributes map[string][]string
+		want       bool
+	}{
+		{"value", values, map[string][]string{"memberOf": {"chem200", "bio101"}}, true},
+		{"other value", values, map[string][]string{"memberOf": {"bio1011"}}, false},
+		{"value of another attribute", values, map[string][]string{"groups": {"bio101"}}, false},
+		{"no attributes", values, nil, false},
+		{"email domain", domains, map[string][]string{"mail": {"alice@example.edu"}}, true},
+		{"subdomain", domains, map[string][]string{"mail": {"alice@cs.example.edu"}}, true},
+		{"case", domains, map[string][]string{"mail": {"Alice@CS.EXAMPLE.edu"}}, true},
+		{"suffix that isn't a subdomain", domains, map[string][]string{"mail": {"alice@badexample.edu"}}, false},
+		{"domain in the local part", domains, map[string][]string{"mail": {"example.edu@evil.org"}}, false},
+		{"domain that extends it", domains, map[string][]string{"mail": {"alice@example.edu.evil.org"}}, false},
+		{"not an address", domains, map[string][]string{"mail": {"example.edu"}}, false},
+		{"any of the addresses", domains, map[string][]string{"mail": {"alice@evil.org", "alice@example.edu"}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.rule.matches(test.attributes); got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAttributeAuthorizer(t *testing.T) {
+	rules := []*attributeRule{
+		{Combine: combineAllOf, Attribute: "memberOf", Values: []string{"bio101"}},
+		{Combine: combineAnyOf, Attribute: "eduPersonAffiliation", Values: []string{"faculty"}, Level: "write"},
+		{Combine: combineAnyOf, Attribute: "mail", EmailDomains: []string{"example.edu"}, Level: "read"},
+	}
+	student := map[string][]string{"memberOf": {"bio101"}, "mail": {"alice@example.edu"}}
+	faculty := map[string][]string{"memberOf": {"bio101"}, "eduPersonAffiliation": {"faculty"}, "mail": {"bob@example.edu"}}
+	outsider := map[string][]string{"memberOf": {"bio101"}, "mail": {"carol@example.org"}}
+	nonMember := map[string][]string{"eduPersonAffiliation": {"faculty"}}
+
+	tests := []struct {
+		name       string
+		next       *Decision
+		attributes map[string][]string
+		method     string
+		path       string
+		reason     string // Empty if the request is allowed.
+		asked      bool   // Whether the wrapped Authorizer is asked.
+	}{
+		{"all-of rule denies", allow(), nonMember, "GET", "/", "must have one of these values of memberOf", false},
+		{"next allows", allow(), outsider, "POST", "/api/v1", "", true},
+		{"next denies without a grant", deny("no"), outsider, "GET", "/", "no", true},
+		{"any-of grant", deny("no"), student, "GET", "/", "", true},
+		{"grant isn't enough", deny("no"), student, "POST", "/api/v1", "requires write access, but alice has read access", true},
+		{"highest grant", deny("no"), faculty, "POST", "/api/v1", "", true},
+		{"explicit deny beats a grant", &Decision{Reason: "suspended", Explicit: true}, faculty, "GET", "/", "suspended", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := &stubAuthorizer{decision: test.next}
+			a := NewAttributeAuthorizer(next, testPolicy, rules)
+			d, err := a.Authorize(&AccessRequest{Username: "alice", Attributes: test.attributes, Method: test.method, Path: test.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != (test.reason == "") {
+				t.Fatalf("expected allowed to be %t, got %+v", test.reason == "", d)
+			}
+			if !strings.Contains(d.Reason, test.reason) {
+				t.Errorf("expected a reason containing %q, got %q", test.reason, d.Reason)
+			}
+			if asked := next.calls > 0; asked != test.asked {
+				t.Errorf("expected the wrapped authorizer to be asked to be %t, got %t", test.asked, asked)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// ErrNotLoggedIn is returned by an Authenticator's Callback when a passive
+// login ends without the user logging in because they don't have a single
+// sign-on session.
+var ErrNotLoggedIn = errors.New("the user does not have a single sign-on session")
+
+// ErrRestartLogin is returned by an Authenticator's Callback when the login
+// can't be finished in this browser, such as when its login state cookie is
+// missing, so the user should be sent to the returned URL to log in again.
+var ErrRestartLogin = errors.New("the login has to be started again")
+
+// Identity is the user returned by an Authenticator after a successful login.
+type Identity struct {
+	Username   string
+	Attributes map[string][]string
+
+	// Identifies the login to the provider, so that the sessions created from
+	// it can be revoked when the provider reports that the user logged out.
+	SessionIndex string
+
+	// True if the user entered their credentials for this login instead of
+	// reusing a single sign-on session.
+	Reauthenticated bool
+
+	// Provider-specific values to store in the session, such as CAS
+	// proxy-granting tickets.
+	Extra map[string]string
+
+	// When the identity stops being valid on its own, such as when a bearer
+	// token expires. Zero if it doesn't.
+	Expires time.Time
+}
+
+// LoginOptions change how an Authenticator asks the user to log in.
+type LoginOptions struct {
+	// Passive logins only use an existing single sign-on session and never
+	// prompt the user for credentials.
+	Passive bool
+
+	// ForceReauth logins prompt the user for credentials even if there's an
+	// existing single sign-on session.
+	ForceReauth bool
+}
+
+// Authenticator is implemented by each of the supported login mechanisms. The
+// proxy takes care of sessions, authorization, and forwarding requests, while
+// the Authenticator only establishes who the user is.
+type Authenticator interface {
+	// Routes adds any endpoints that the provider needs, such as back-channel
+	// callbacks, to the router. They're added before the routes that require
+	// a session.
+	Routes(r *mux.Router, p *CASProxy)
+
+	// IsCallback returns true if the request is the user returning from
+	// logging in with the provider.
+	IsCallback(r *http.Request) bool
+
+	// Callback completes the login for a callback request, returning the
+	// user's identity and the URL to send them back to. ErrNotLoggedIn is
+	// returned along with the URL if a passive login found no session. Any
+	// cookies that only lasted for the login are cleared with the writer.
+	Callback(w http.ResponseWriter, r *http.Request, opts LoginOptions) (*Identity, string, error)
+
+	// LoginRedirect sends the user to the provider to log in.
+	LoginRedirect(w http.ResponseWriter, r *http.Request, opts LoginOptions)
+
+	// LogoutURL returns the URL to send the user to once their session with
+	// the proxy has ended, so that they can log out of the provider as well.
+	// The service is an optional URL to return to afterwards.
+	LogoutURL(service string) (string, error)
+}
+
+// PasswordAuthenticator is implemented by Authenticators that can check a
+// username and password directly, for clients that can't follow a login in a
+// browser.
+type PasswordAuthenticator interface {
+	PasswordLogin(username, password string) (*Identity, error)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// AccessRequest describes a request that a user is making to the analysis.
+type AccessRequest struct {
+	Username   string
+	Attributes map[string][]string // The attributes released by the provider. Nil if there aren't any.
+	Resource   string              // The analysis ID. Empty if it isn't known.
+	Method     string              // The HTTP method, or WEBSOCKET for websocket requests.
+	Path       string
+}
+
+// Decision is an Authorizer's answer to an AccessRequest.
+type Decision struct {
+	Allowed  bool
+	Reason   string // Why access was denied.
+	Explicit bool   // Access was denied by a rule against it, not for a lack of access.
+}
+
+// allow and deny return decisions.
+func allow() *Decision {
+	return &Decision{Allowed: true}
+}
+
+func deny(format string, args ...interface{}) *Decision {
+	return &Decision{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Authorizer decides whether users can make requests. An error means that no
+// decision could be made, and the request should be denied.
+type Authorizer interface {
+	Authorize(req *AccessRequest) (*Decision, error)
+}
+
+// PermissionsAuthorizer is the Authorizer that asks the permissions service,
+// through the cluster ingress, for the user's permission level for the
+// analysis. Which requests each level allows is set by the access policy.
+type PermissionsAuthorizer struct {
+	ingressURL   string         // The URL to the cluster ingress.
+	accessHeader string         // The Host header for checking resource access perms.
+	policy       accessPolicy   // What each permission level allows. Nil if any level allows everything.
+	decisions    *decisionCache // Caches permission levels. Nil if they aren't cached.
+	client       *http.Client
+}
+
+// NewPermissionsAuthorizer returns a newly instantiated *PermissionsAuthorizer.
+// The policy and cache are optional.
+func NewPermissionsAuthorizer(ingressURL, accessHeader string, policy accessPolicy, decisions *decisionCache, client *http.Client) *PermissionsAuthorizer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &PermissionsAuthorizer{
+		ingressURL:   ingressURL,
+		accessHeader: accessHeader,
+		policy:       policy,
+		decisions:    decisions,
+		client:       client,
+	}
+}
+
+// Authorize allows the request if the user's permission level allows it.
+func (a *PermissionsAuthorizer) Authorize(req *AccessRequest) (*Decision, error) {
+	level, err := a.PermissionLevel(req.Username, req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return a.policy.Decide(req, level), nil
+}
+
+// PermissionLevel returns the user's highest permission level for the
+// resource, or an empty string if they don't have any. Levels are cached, if
+// the cache is enabled.
+func (a *PermissionsAuthorizer) PermissionLevel(user, resource string) (string, error) {
+	if a.decisions == nil {
+		return a.checkAccess(user, resource)
+	}
+	return a.decisions.Get(user, resource, func() (string, error) {
+		return a.checkAccess(user, resource)
+	})
+}
+
+// checkAccess asks the permissions service for the user's permission level for
+// the resource.
+func (a *PermissionsAuthorizer) checkAccess(user, resource string) (string, error) {
+	bodymap := map[string]string{
+		"subject":  user,
+		"resource": resource,
+	}
+
+	body, err := json.Marshal(bodymap)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, a.ingressURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	request.Host = a.accessHeader
+
+	resp, err := a.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	l := &PermissionList{
+		Permissions: []Permission{},
+	}
+
+	if err = json.Unmarshal(b, l); err != nil {
+		return "", err
+	}
+
+	levels := []string{}
+	for _, p := range l.Permissions {
+		levels = append(levels, p.Level)
+	}
+	return highestLevel(levels), nil
+}
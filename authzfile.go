@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultGroupsAttribute is the attribute that the groups in authorization
+// files are matched against, unless the file says otherwise.
+const defaultGroupsAttribute = "memberOf"
+
+// The effects of the rules in authorization files.
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// fileRule allows or denies the requests that it matches. It matches requests
+// by any of the users, or by members of any of the groups, or by anyone if
+// neither are listed. A user of "*" matches everyone. The methods and paths
+// are matched like the rules of access policies.
+type fileRule struct {
+	accessRule
+	Effect string   `json:"effect"`
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+}
+
+// matchesSubject returns true if the rule applies to the user making the
+// request.
+func (r *fileRule) matchesSubject(req *AccessRequest, groupsAttribute string) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	for _, u := range r.Users {
+		if u == "*" || u == req.Username {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, member := range req.Attributes[groupsAttribute] {
+			if g == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authzFile is the contents of an authorization file.
+type authzFile struct {
+	GroupsAttribute string     `json:"groups_attribute"`
+	Rules           []fileRule `json:"rules"`
+}
+
+// readAuthzFile reads and checks the authorization file.
+func readAuthzFile(file string) (*authzFile, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read authorization file %s", file)
+	}
+
+	f := &authzFile{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err = d.Decode(f); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse authorization file %s", file)
+	}
+
+	if f.GroupsAttribute == "" {
+		f.GroupsAttribute = defaultGroupsAttribute
+	}
+
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if rule.Effect != effectAllow && rule.Effect != effectDeny {
+			return nil, fmt.Errorf("rule %d in authorization file %s has an effect of %q instead of allow or deny", i+1, file, rule.Effect)
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+		for _, pattern := range rule.Paths {
+			if _, err = path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid path pattern %s in rule %d of authorization file %s", pattern, i+1, file)
+			}
+		}
+	}
+	return f, nil
+}
+
+// FileAuthorizer is the Authorizer that decides with the rules in a local JSON
+// file, for running the proxy without the apps and permissions services. The
+// first rule that matches a request decides it, and requests that don't match
+// any are denied. The file is reloaded when it changes.
+//
+// An authorization file looks like:
+//
+//	{
+//	  "groups_attribute": "memberOf",
+//	  "rules": [
+//	    {"effect": "deny", "users": ["mallory"]},
+//	    {"effect": "allow", "groups": ["workshop"], "methods": ["GET", "HEAD"]},
+//	    {"effect": "allow", "users": ["instructor"]}
+//	  ]
+//	}
+type FileAuthorizer struct {
+	file    string
+	mutex   sync.RWMutex
+	current *authzFile
+	modTime time.Time // When the file was modified the last time it was read.
+	size    int64
+}
+
+// NewFileAuthorizer returns a newly instantiated *FileAuthorizer after loading
+// the file. If the interval isn't zero, the file is checked for changes that
+// often.
+func NewFileAuthorizer(file string, interval time.Duration) (*FileAuthorizer, error) {
+	a := &FileAuthorizer{file: file}
+	if _, err := a.reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go a.watch(interval)
+	}
+	return a, nil
+}
+
+// reload loads the file if it has changed since it was last read, returning
+// true if it did. The old rules are kept if it can't be loaded, and it isn't
+// read again until it changes.
+func (a *FileAuthorizer) reload() (bool, error) {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read authorization file %s", a.file)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.current != nil && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return false, nil
+	}
+	a.modTime = info.ModTime()
+	a.size = info.Size()
+
+	f, err := readAuthzFile(a.file)
+	if err != nil {
+		return false, err
+	}
+	a.current = f
+	return true, nil
+}
+
+// watch reloads the file whenever it changes.
+func (a *FileAuthorizer) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := a.reload()
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed to reload the authorization file, so the old rules are still in use"))
+			continue
+		}
+		if reloaded {
+			log.Infof("reloaded authorization file %s", a.file)
+		}
+	}
+}
+
+// Authorize decides the request with the first rule that matches it.
+func (a *FileAuthorizer) Authorize(req *AccessRequest) (*Decision, error) {
+	a.mutex.RLock()
+	f := a.current
+	a.mutex.RUnlock()
+
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if !rule.matchesSubject(req, f.GroupsAttribute) || !rule.matches(req.Method, req.Path) {
+			continue
+		}
+		if rule.Effect == effectDeny {
+			d := deny("rule %d in the authorization file denies %s %s to %s", i+1, req.Method, req.Path, req.Username)
+			d.Explicit = true
+			return d, nil
+		}
+		return allow(), nil
+	}
+	return deny("no rule in the authorization file allows %s %s to %s", req.Method, req.Path, req.Username), nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuthzFile = `{
+  "groups_attribute": "groups",
+  "rules": [
+    {"effect": "deny", "users": ["mallory"]},
+    {"effect": "deny", "groups": ["suspended"], "methods": ["post"]},
+    {"effect": "allow", "groups": ["workshop"], "methods": ["GET", "HEAD"]},
+    {"effect": "allow", "users": ["instructor", "ta"]},
+    {"effect": "allow", "users": ["*"], "paths": ["/public/"]}
+  ]
+}`
+
+// writeAuthzFile writes the contents to the file and sets its modification
+// time, so that changes are noticed even within the file system's timestamp
+// resolution.
+func writeAuthzFile(t *testing.T, file, contents string, modTime time.Time) {
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "authz.json")
+	writeAuthzFile(t, file, testAuthzFile, time.Now())
+
+	a, err := NewFileAuthorizer(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		groups   []string
+		method   string
+		path     string
+		allowed  bool
+		explicit bool
+	}{
+		{"listed user", "instructor", nil, "POST", "/", true, false},
+		{"another listed user", "ta", nil, "DELETE", "/x", true, false},
+		{"group member", "alice", []string{"other", "workshop"}, "GET", "/", true, false},
+		{"group member with another method", "alice", []string{"workshop"}, "POST", "/", false, false},
+		{"not a member", "bob", []string{"other"}, "GET", "/", false, false},
+		{"anyone on a public path", "bob", nil, "POST", "/public/a", true, false},
+		{"denied user", "mallory", []string{"workshop"}, "GET", "/public/a", false, true},
+		{"deny before allow", "instructor", []string{"suspended"}, "POST", "/", false, true},
+		{"deny that doesn't match the method", "instructor", []string{"suspended"}, "GET", "/", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := a.Authorize(&AccessRequest{
+				Username:   test.user,
+				Attributes: map[string][]string{"groups": test.groups, "memberOf": {"workshop"}},
+				Method:     test.method,
+				Path:       test.path,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != test.allowed || d.Explicit != test.explicit {
+				t.Errorf("expected allowed %t and explicit %t, got %+v", test.allowed, test.explicit, d)
+			}
+		})
+	}
+}
+
+func TestReadAuthzFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{"default groups attribute", `{"rules": [{"effect": "allow"}]}`, ""},
+		{"unknown effect", `{"rules": [{"effect": "permit"}]}`, `rule 1 in authorization file`},
+		{"missing effect", `{"rules": [{"effect": "allow"}, {"users": ["alice"]}]}`, `rule 2 in authorization file`},
+		{"unknown field", `{"rules": [{"effect": "allow", "user": ["alice"]}]}`, "failed to parse"},
+		{"bad pattern", `{"rules": [{"effect": "allow", "paths": ["/["]}]}`, "invalid path pattern"},
+		{"not JSON", `allow alice`, "failed to parse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "authz.json")
+			writeAuthzFile(t, file, test.contents, time.Now())
+
+			f, err := readAuthzFile(file)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.GroupsAttribute != defaultGroupsAttribute {
+				t.Errorf("expected the groups attribute to default to %s, got %s", defaultGroupsAttribute, f.GroupsAttribute)
+			}
+		})
+	}
+}
+
+func TestFileAuthorizerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "authz.json")
+
+	if _, err = NewFileAuthorizer(file, 0); err == nil {
+		t.Error("expected a missing file to be an error at startup")
+	}
+
+	start := time.Now().Add(-time.Hour)
+	writeAuthzFile(t, file, `{"rules": [{"effect": "allow", "users": ["alice"]}]}`, start)
+	a, err := NewFileAuthorizer(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := func(user string) bool {
+		d, err := a.Authorize(&AccessRequest{Username: user, Method: "GET", Path: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Allowed
+	}
+
+	// Unchanged files aren't read again.
+	if reloaded, err := a.reload(); reloaded || err != nil {
+		t.Errorf("expected an unchanged file not to be reloaded, got %t, %v", reloaded, err)
+	}
+
+	// Changes are picked up.
+	writeAuthzFile(t, file, `{"rules": [{"effect": "allow", "users": ["bob"]}]}`, start.Add(time.Minute))
+	if reloaded, err := a.reload(); !reloaded || err != nil {
+		t.Fatalf("expected the changed file to be reloaded, got %t, %v", reloaded, err)
+	}
+	if allowed("alice") || !allowed("bob") {
+		t.Error("expected the new rules to be used")
+	}
+
+	// Malformed files leave the old rules in place, and aren't read again
+	// until they change.
+	writeAuthzFile(t, file, `{"rules": [`, start.Add(2*time.Minute))
+	if _, err = a.reload(); err == nil {
+		t.Error("expected a malformed file to be an error")
+	}
+	if !allowed("bob") {
+		t.Error("expected the old rules to be kept after a malformed file")
+	}
+	if reloaded, err := a.reload(); reloaded || err != nil {
+		t.Errorf("expected the malformed file not to be read again, got %t, %v", reloaded, err)
+	}
+
+	// So do missing files.
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.reload(); err == nil {
+		t.Error("expected a missing file to be an error")
+	}
+	if !allowed("bob") {
+		t.Error("expected the old rules to be kept after the file was removed")
+	}
+
+	// A fixed file is picked up again.
+	writeAuthzFile(t, file, `{"rules": [{"effect": "allow", "users": ["carol"]}]}`, start.Add(3*time.Minute))
+	if reloaded, err := a.reload(); !reloaded || err != nil {
+		t.Fatalf("expected the fixed file to be reloaded, got %t, %v", reloaded, err)
+	}
+	if !allowed("carol") {
+		t.Error("expected the fixed file's rules to be used")
+	}
+}
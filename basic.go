@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// basicRealm is the challenge sent to clients whose Basic credentials are
+// rejected.
+const basicRealm = `Basic realm="cas-proxy", charset="UTF-8"`
+
+type basicCacheEntry struct {
+	id      *Identity
+	expires time.Time
+}
+
+// basicCache remembers recently accepted Basic credentials so that the
+// provider isn't asked to check them on every request. Entries are keyed by an
+// HMAC of the credentials with a random key, so the passwords aren't kept in
+// memory.
+type basicCache struct {
+	mutex   sync.Mutex
+	key     []byte
+	ttl     time.Duration
+	entries map[string]*basicCacheEntry
+}
+
+func newBasicCache(ttl time.Duration) (*basicCache, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &basicCache{
+		key:     key,
+		ttl:     ttl,
+		entries: map[string]*basicCacheEntry{},
+	}, nil
+}
+
+func (b *basicCache) hash(username, password string) string {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get returns the identity for the credentials if they were accepted recently.
+func (b *basicCache) Get(username, password string) (*Identity, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, ok := b.entries[b.hash(username, password)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.id, true
+}
+
+// Put remembers that the credentials were accepted for the identity.
+func (b *basicCache) Put(username, password string, id *Identity) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	for k, v := range b.entries {
+		if now.After(v.expires) {
+			delete(b.entries, k)
+		}
+	}
+
+	b.entries[b.hash(username, password)] = &basicCacheEntry{
+		id:      id,
+		expires: now.Add(b.ttl),
+	}
+}
+
+// usesBasicAuth returns true if the request has Basic credentials for a path
+// that accepts them.
+func (c *CASProxy) usesBasicAuth(r *http.Request) bool {
+	if c.passwords == nil || !c.basicPaths.Match(r.URL.Path) {
+		return false
+	}
+	_, _, ok := r.BasicAuth()
+	return ok
+}
+
+// basicLogin checks the request's Basic credentials with the provider, or
+// with the cache if they were accepted recently.
+func (c *CASProxy) basicLogin(r *http.Request) (*Identity, error) {
+	username, password, _ := r.BasicAuth()
+	if id, ok := c.basicCache.Get(username, password); ok {
+		return id, nil
+	}
+
+	id, err := c.passwords.PasswordLogin(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	c.basicCache.Put(username, password, id)
+	return id, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBasicCache(t *testing.T) {
+	b, err := newBasicCache(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &Identity{Username: "alice"}
+	b.Put("alice", "secret", alice)
+
+	if id, ok := b.Get("alice", "secret"); !ok || id != alice {
+		t.Errorf("expected alice's identity, got %v, %t", id, ok)
+	}
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "secret"}, {"alicesecret", ""}, {"", "alicesecret"}} {
+		if _, ok := b.Get(creds[0], creds[1]); ok {
+			t.Errorf("expected %q and %q not to match alice's credentials", creds[0], creds[1])
+		}
+	}
+
+	// Expired entries aren't returned, and they're pruned by later puts.
+	for _, e := range b.entries {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	if _, ok := b.Get("alice", "secret"); ok {
+		t.Error("expected expired credentials not to be returned")
+	}
+	b.Put("bob", "secret", &Identity{Username: "bob"})
+	if len(b.entries) != 1 {
+		t.Errorf("expected the expired entry to be pruned, got %d entries", len(b.entries))
+	}
+}
+
+func TestBasicLogin(t *testing.T) {
+	c := newTestCAS(t)
+	defer c.Close()
+
+	bc, err := newBasicCache(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &CASProxy{passwords: newTestPGTAuthenticator(c), basicCache: bc}
+
+	login := func(password string) error {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("alice", password)
+		_, err := p.basicLogin(r)
+		return err
+	}
+
+	// Wrong passwords are checked with CAS every time, and aren't cached.
+	for i := 1; i <= 2; i++ {
+		if err = login("wrong"); err == nil {
+			t.Fatal("expected the wrong password to be rejected")
+		}
+		if c.logins != i {
+			t.Fatalf("expected %d logins with CAS, got %d", i, c.logins)
+		}
+	}
+
+	// The right password is only checked with CAS once.
+	for i := 0; i < 3; i++ {
+		if err = login("secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.logins != 3 {
+		t.Errorf("expected the right password to be cached, got %d logins", c.logins)
+	}
+
+	// A cached success doesn't let a wrong password in.
+	if err = login("wrong"); err == nil || c.logins != 4 {
+		t.Errorf("expected the wrong password to be checked with CAS and rejected, got %v after %d logins", err, c.logins)
+	}
+
+	// Once the cached success expires, CAS is asked again.
+	for _, e := range bc.entries {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	if err = login("secret"); err != nil || c.logins != 5 {
+		t.Errorf("expected expired credentials to be checked with CAS again, got %v after %d logins", err, c.logins)
+	}
+}
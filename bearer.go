@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BearerConfig contains the settings for accepting JSON Web Tokens in the
+// Authorization header.
+type BearerConfig struct {
+	Keys          listFlags     // Paths to PEM-encoded public keys.
+	JWKS          string        // The URL or path of a JSON Web Key Set.
+	Issuer        string        // The required iss claim.
+	Audience      string        // The required aud claim.
+	UsernameClaim string        // The claim that contains the username.
+	ClockSkew     time.Duration // The clock skew allowed when checking expiry.
+}
+
+// AddFlags adds the command-line flags for bearer tokens to the flag set.
+func (cfg *BearerConfig) AddFlags(fs *flag.FlagSet) {
+	fs.Var(&cfg.Keys, "jwt-keys", "List of paths to PEM-encoded public keys or certificates, separated by commas, that bearer tokens may be signed with.")
+	fs.StringVar(&cfg.JWKS, "jwt-jwks", "", "The URL or path of a JSON Web Key Set that bearer tokens may be signed with.")
+	fs.StringVar(&cfg.Issuer, "jwt-issuer", "", "The issuer that bearer tokens must have. Required with --jwt-keys or --jwt-jwks.")
+	fs.StringVar(&cfg.Audience, "jwt-audience", "", "The audience that bearer tokens must be intended for. Required with --jwt-keys or --jwt-jwks.")
+	fs.StringVar(&cfg.UsernameClaim, "jwt-username-claim", "preferred_username", "The bearer token claim that contains the username.")
+}
+
+// Enabled returns true if keys for verifying bearer tokens were configured.
+func (cfg *BearerConfig) Enabled() bool {
+	return len(cfg.Keys) > 0 || cfg.JWKS != ""
+}
+
+// BearerAuthenticator identifies users from the JSON Web Tokens that
+// non-browser clients send in the Authorization header instead of a session
+// cookie.
+type BearerAuthenticator struct {
+	keys          keySource
+	issuer        string
+	audience      string
+	usernameClaim string
+	clockSkew     time.Duration
+}
+
+// NewBearerAuthenticator returns a newly instantiated *BearerAuthenticator
+// after checking the configuration and loading the keys.
+func NewBearerAuthenticator(cfg *BearerConfig) (*BearerAuthenticator, error) {
+	if len(cfg.Keys) > 0 && cfg.JWKS != "" {
+		return nil, errors.New("only one of --jwt-keys and --jwt-jwks may be set")
+	}
+
+	if cfg.Issuer == "" {
+		return nil, errors.New("--jwt-issuer must be set to accept bearer tokens")
+	}
+
+	if cfg.Audience == "" {
+		return nil, errors.New("--jwt-audience must be set to accept bearer tokens")
+	}
+
+	if cfg.UsernameClaim == "" {
+		return nil, errors.New("--jwt-username-claim must not be empty")
+	}
+
+	b := &BearerAuthenticator{
+		issuer:        cfg.Issuer,
+		audience:      cfg.Audience,
+		usernameClaim: cfg.UsernameClaim,
+		clockSkew:     cfg.ClockSkew,
+	}
+
+	if cfg.JWKS != "" {
+		j := newJWKSKeys(cfg.JWKS, &http.Client{Timeout: 30 * time.Second})
+		if _, err := j.Keys(""); err != nil {
+			return nil, err
+		}
+		b.keys = j
+		log.Infof("bearer token key set is %s", cfg.JWKS)
+	} else {
+		keys, err := loadPEMKeys(cfg.Keys)
+		if err != nil {
+			return nil, err
+		}
+		b.keys = keys
+		log.Infof("loaded %d bearer token keys", len(keys))
+	}
+
+	log.Infof("bearer token issuer is %s", b.issuer)
+	log.Infof("bearer token audience is %s", b.audience)
+
+	return b, nil
+}
+
+// Identify verifies the token and returns the user that it was issued to.
+func (b *BearerAuthenticator) Identify(raw string) (*Identity, error) {
+	token, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := b.keys.Keys(token.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = token.verifyWithKeys(keys); err != nil {
+		return nil, err
+	}
+
+	if err = token.checkClaims(b.issuer, b.audience, time.Now(), b.clockSkew); err != nil {
+		return nil, err
+	}
+
+	username := token.stringClaim(b.usernameClaim)
+	if username == "" {
+		return nil, fmt.Errorf("token does not have a %s claim", b.usernameClaim)
+	}
+
+	// checkClaims already made sure that there's an expiration time.
+	exp, _ := token.timeClaim("exp")
+
+	return &Identity{
+		Username:   username,
+		Attributes: token.attributes(),
+		Expires:    exp.Add(b.clockSkew),
+	}, nil
+}
+
+// bearerToken returns the token from the request's Authorization header if it
+// uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
+// staticKeys is a fixed set of keys. Key IDs are ignored, so every key is
+// tried.
+type staticKeys []crypto.PublicKey
+
+// Keys returns all of the keys.
+func (s staticKeys) Keys(kid string) ([]crypto.PublicKey, error) {
+	return s, nil
+}
+
+// loadPEMKeys reads the public keys from the PEM files. Each file can contain
+// any number of public keys and certificates.
+func loadPEMKeys(paths []string) (staticKeys, error) {
+	keys := staticKeys{}
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read key file %s", p)
+		}
+
+		found := false
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+
+			var key crypto.PublicKey
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "RSA PUBLIC KEY":
+				key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+					key = cert.PublicKey
+				}
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse %s in %s", strings.ToLower(block.Type), p)
+			}
+
+			keys = append(keys, key)
+			found = true
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no public keys found in %s", p)
+		}
+	}
+	return keys, nil
+}
+
+// usesBearer returns true if the request has a bearer token and bearer tokens
+// are accepted.
+func (c *CASProxy) usesBearer(r *http.Request) bool {
+	_, ok := bearerToken(r)
+	return ok && c.bearer != nil
+}
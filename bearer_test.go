@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer  abc ", "abc", true},
+		{"Bearer", "", false},
+		{"Bearer ", "", false},
+		{"Basic YWxpY2U6cHc=", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", test.header)
+		token, ok := bearerToken(r)
+		if token != test.token || ok != test.ok {
+			t.Errorf("%q: expected %q, %t, got %q, %t", test.header, test.token, test.ok, token, ok)
+		}
+	}
+}
+
+func TestBearerIdentify(t *testing.T) {
+	b := &BearerAuthenticator{
+		keys:          staticKeys{&testOtherKey.PublicKey, &testRSAKey.PublicKey},
+		issuer:        "https://issuer.example.org",
+		audience:      "app",
+		usernameClaim: "preferred_username",
+		clockSkew:     30 * time.Second,
+	}
+	exp := time.Now().Add(time.Minute).Truncate(time.Second)
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		change func(map[string]interface{})
+		err    string
+	}{
+		{"valid", testRSAKey, func(map[string]interface{}) {}, ""},
+		{"unknown key", testECKey, func(map[string]interface{}) {}, "token signature is invalid"},
+		{"no username", testRSAKey, func(c map[string]interface{}) { delete(c, "preferred_username") }, "does not have a preferred_username claim"},
+		{"other audience", testRSAKey, func(c map[string]interface{}) { c["aud"] = "other" }, "not intended for app"},
+		{"expired", testRSAKey, func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, "token has expired"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := map[string]interface{}{
+				"iss":                "https://issuer.example.org",
+				"aud":                "app",
+				"exp":                exp.Unix(),
+				"preferred_username": "alice",
+				"groups":             []string{"g1"},
+			}
+			test.change(claims)
+			alg := "RS256"
+			if test.key == testECKey {
+				alg = "ES256"
+			}
+
+			id, err := b.Identify(signTestJWT(t, alg, "", test.key, claims))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Username != "alice" || len(id.Attributes["groups"]) != 1 {
+				t.Errorf("expected alice in g1, got %+v", id)
+			}
+			if want := exp.Add(30 * time.Second); !id.Expires.Equal(want) {
+				t.Errorf("expected the identity to expire at %s, got %s", want, id.Expires)
+			}
+		})
+	}
+}
+
+func TestLoadPEMKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkix, err := x509.MarshalPKIXPublicKey(&testRSAKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := x509.MarshalPKIXPublicKey(&testECKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := append(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&testOtherKey.PublicKey)})...)
+
+	files := map[string][]byte{
+		"keys.pem":  keys,
+		"ec.pem":    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ec}),
+		"empty.pem": []byte("not a key\n"),
+	}
+	for name, b := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := loadPEMKeys([]string{filepath.Join(dir, "keys.pem"), filepath.Join(dir, "ec.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(loaded))
+	}
+
+	if _, err = loadPEMKeys([]string{filepath.Join(dir, "empty.pem")}); err == nil || !strings.Contains(err.Error(), "no public keys found") {
+		t.Errorf("expected a file without keys to be an error, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// sessionCertFingerprint is the session key for the fingerprint of the TLS
+// client certificate that the user logged in with.
+const sessionCertFingerprint = "proxy-session-cert-fingerprint"
+
+// The client characteristics that sessions can be bound to.
+const (
+	bindIP        = "ip"
+	bindSubnet    = "subnet"
+	bindUserAgent = "user-agent"
+	bindTLSCert   = "tls-cert"
+)
+
+// The values of --session-binding-policy.
+const (
+	bindingEnforce = "enforce"
+	bindingAudit   = "audit"
+)
+
+// sessionBinding is the set of client characteristics that must stay the same
+// for the life of a session. A session cookie that's used from a client that
+// doesn't match the one that logged in has probably been stolen.
+type sessionBinding struct {
+	ip         bool
+	subnet     bool
+	userAgent  bool
+	tlsCert    bool
+	ipv4Prefix int  // The prefix length of IPv4 subnets.
+	ipv6Prefix int  // The prefix length of IPv6 subnets.
+	enforce    bool // Whether mismatches end the session or are only logged.
+}
+
+// newSessionBinding returns the binding for the values of --session-binding
+// and the related flags. It returns nil if sessions aren't bound to anything.
+func newSessionBinding(characteristics []string, policy string, ipv4Prefix, ipv6Prefix int) (*sessionBinding, error) {
+	if len(characteristics) == 0 {
+		return nil, nil
+	}
+
+	b := &sessionBinding{
+		ipv4Prefix: ipv4Prefix,
+		ipv6Prefix: ipv6Prefix,
+	}
+	for _, c := range characteristics {
+		switch strings.TrimSpace(c) {
+		case bindIP:
+			b.ip = true
+		case bindSubnet:
+			b.subnet = true
+		case bindUserAgent:
+			b.userAgent = true
+		case bindTLSCert:
+			b.tlsCert = true
+		default:
+			return nil, fmt.Errorf("--session-binding must be a list of: ip, subnet, user-agent, tls-cert, not %s", c)
+		}
+	}
+
+	switch policy {
+	case bindingEnforce:
+		b.enforce = true
+	case bindingAudit:
+	default:
+		return nil, fmt.Errorf("--session-binding-policy must be one of: enforce, audit, not %s", policy)
+	}
+
+	if ipv4Prefix < 0 || ipv4Prefix > 32 {
+		return nil, fmt.Errorf("--session-binding-ipv4-prefix must be between 0 and 32, not %d", ipv4Prefix)
+	}
+	if ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("--session-binding-ipv6-prefix must be between 0 and 128, not %d", ipv6Prefix)
+	}
+
+	return b, nil
+}
+
+// sameSubnet returns true if the addresses are in the same subnet, using the
+// prefix length for their address family.
+func (b *sessionBinding) sameSubnet(a, c net.IP) bool {
+	bits, prefix := 128, b.ipv6Prefix
+	if a.To4() != nil {
+		a, c = a.To4(), c.To4()
+		bits, prefix = 32, b.ipv4Prefix
+	}
+	if c == nil || len(a) != len(c) {
+		return false
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return a.Mask(mask).Equal(c.Mask(mask))
+}
+
+// mismatches returns the characteristics of the request's client that don't
+// match the ones recorded in the session when the user logged in. Sessions
+// from before the binding was enabled don't have them, so they don't match.
+func (b *sessionBinding) mismatches(r *http.Request, session *sessions.Session, ip string) []string {
+	found := []string{}
+
+	loginIP, _ := session.Values[sessionClientIP].(string)
+	if b.ip && loginIP != ip {
+		found = append(found, bindIP)
+	}
+	if b.subnet {
+		a, c := net.ParseIP(loginIP), net.ParseIP(ip)
+		if a == nil || c == nil || !b.sameSubnet(a, c) {
+			found = append(found, bindSubnet)
+		}
+	}
+
+	if b.userAgent {
+		ua, ok := session.Values[sessionUserAgent].(string)
+		if !ok || ua != r.UserAgent() {
+			found = append(found, bindUserAgent)
+		}
+	}
+
+	if b.tlsCert {
+		fp, _ := session.Values[sessionCertFingerprint].(string)
+		if fp == "" || fp != certFingerprint(r) {
+			found = append(found, bindTLSCert)
+		}
+	}
+
+	return found
+}
+
+// certFingerprint returns the SHA-256 fingerprint of the client's TLS
+// certificate, or an empty string if it didn't present one.
+func certFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkBinding returns an error if the request's client doesn't match the one
+// that logged in and the policy is to enforce the binding. Mismatches are
+// logged as audit events either way.
+func (c *CASProxy) checkBinding(r *http.Request, session *sessions.Session) error {
+	if c.binding == nil {
+		return nil
+	}
+
+	ip := c.clientIP(r)
+	found := c.binding.mismatches(r, session, ip)
+	if len(found) == 0 {
+		return nil
+	}
+
+	username, _ := session.Values[sessionKey].(string)
+	loginIP, _ := session.Values[sessionClientIP].(string)
+	log.WithFields(logrus.Fields{
+		"audit":      "session-binding",
+		"user":       username,
+		"mismatches": strings.Join(found, ","),
+		"login-ip":   loginIP,
+		"client-ip":  ip,
+		"enforced":   c.binding.enforce,
+	}).Warn("session used from a client that doesn't match the one that logged in")
+
+	if c.binding.enforce {
+		return fmt.Errorf("session for %s doesn't match the client: %s", username, strings.Join(found, ", "))
+	}
+	return nil
+}
+
+// ipNets is a list of networks in CIDR notation, separated by commas on the
+// command line. Single addresses are accepted as well.
+type ipNets []*net.IPNet
+
+func (n *ipNets) String() string {
+	s := []string{}
+	for _, ipnet := range *n {
+		s = append(s, ipnet.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (n *ipNets) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %s", part)
+			}
+			if ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(part)
+		if err != nil {
+			return errors.Wrapf(err, "invalid network %s", part)
+		}
+		*n = append(*n, ipnet)
+	}
+	return nil
+}
+
+// Contains returns true if the address is in one of the networks.
+func (n ipNets) Contains(ip net.IP) bool {
+	for _, ipnet := range n {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client. If the request came through
+// trusted proxies, the address is the last one in X-Forwarded-For that wasn't
+// added by a trusted proxy, since the ones before it can be forged by the
+// client.
+func (c *CASProxy) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if parsed := net.ParseIP(ip); parsed == nil || !c.trustedProxies.Contains(parsed) {
+		return ip
+	}
+
+	forwarded := []string{}
+	for _, h := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		parsed := net.ParseIP(hop)
+		if parsed == nil {
+			break
+		}
+		ip = hop
+		if !c.trustedProxies.Contains(parsed) {
+			break
+		}
+	}
+	return ip
+}
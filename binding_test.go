@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := ipNets{}
+	if err := trusted.Set("10.0.0.0/8,2001:db8:ffff::/48,192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "198.51.100.7:1234", nil, "198.51.100.7"},
+		{"spoofed header from an untrusted peer", "198.51.100.7:1234", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"trusted single address", "192.0.2.1:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"trusted proxy without a header", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"chain of trusted proxies", "10.1.2.3:1234", []string{"203.0.113.9, 10.9.9.9"}, "203.0.113.9"},
+		{"forged hops before the client", "10.1.2.3:1234", []string{"1.1.1.1, 203.0.113.9"}, "203.0.113.9"},
+		{"several headers", "10.1.2.3:1234", []string{"1.1.1.1", "203.0.113.9, 10.9.9.9"}, "203.0.113.9"},
+		{"garbage before the client", "10.1.2.3:1234", []string{"nonsense, 203.0.113.9"}, "203.0.113.9"},
+		{"garbage from the last proxy", "10.1.2.3:1234", []string{"203.0.113.9, nonsense"}, "10.1.2.3"},
+		{"every hop trusted", "10.1.2.3:1234", []string{"10.9.9.9"}, "10.9.9.9"},
+		{"IPv6 client", "[2001:db8:1::7]:1234", nil, "2001:db8:1::7"},
+		{"IPv6 spoofed header", "[2001:db8:1::7]:1234", []string{"203.0.113.9"}, "2001:db8:1::7"},
+		{"IPv6 trusted proxy", "[2001:db8:ffff::1]:1234", []string{"2001:db8:1::7"}, "2001:db8:1::7"},
+	}
+
+	c := &CASProxy{trustedProxies: trusted}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remote
+			for _, h := range test.xff {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := c.clientIP(r); got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+
+	// Without trusted proxies, the header is always ignored.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := (&CASProxy{}).clientIP(r); got != "10.1.2.3" {
+		t.Errorf("expected the header to be ignored without trusted proxies, got %s", got)
+	}
+}
+
+func TestBindingMismatches(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("alice's certificate")}
+	other := &x509.Certificate{Raw: []byte("mallory's certificate")}
+
+	tests := []struct {
+		name            string
+		characteristics []string
+		loginIP         string
+		ip              string
+		userAgent       string
+		cert            *x509.Certificate
+		want            []string
+	}{
+		{"same client", []string{bindIP, bindUserAgent, bindTLSCert}, "198.51.100.7", "198.51.100.7", "browser/1.0", cert, []string{}},
+		{"other IP", []string{bindIP}, "198.51.100.7", "198.51.100.8", "browser/1.0", cert, []string{bindIP}},
+		{"same IPv4 subnet", []string{bindSubnet}, "198.51.100.7", "198.51.100.200", "browser/1.0", cert, []string{}},
+		{"other IPv4 subnet", []string{bindSubnet}, "198.51.100.7", "198.51.101.7", "browser/1.0", cert, []string{bindSubnet}},
+		{"same IPv6 subnet", []string{bindSubnet}, "2001:db8:1:2::7", "2001:db8:1:2:ffff::1", "browser/1.0", cert, []string{}},
+		{"other IPv6 subnet", []string{bindSubnet}, "2001:db8:1:2::7", "2001:db8:1:3::7", "browser/1.0", cert, []string{bindSubnet}},
+		{"other address family", []string{bindSubnet}, "198.51.100.7", "2001:db8:1:2::7", "browser/1.0", cert, []string{bindSubnet}},
+		{"IPv6 address", []string{bindIP}, "2001:db8:1:2::7", "2001:db8:1:2::7", "browser/1.0", cert, []string{}},
+		{"other user agent", []string{bindUserAgent}, "198.51.100.7", "198.51.100.7", "curl/7.0", cert, []string{bindUserAgent}},
+		{"other certificate", []string{bindTLSCert}, "198.51.100.7", "198.51.100.7", "browser/1.0", other, []string{bindTLSCert}},
+		{"no certificate", []string{bindTLSCert}, "198.51.100.7", "198.51.100.7", "browser/1.0", nil, []string{bindTLSCert}},
+		{"session from before the binding", []string{bindIP, bindSubnet, bindUserAgent}, "", "198.51.100.7", "browser/1.0", cert, []string{bindIP, bindSubnet, bindUserAgent}},
+		{"everything", []string{bindIP, bindSubnet, bindUserAgent, bindTLSCert}, "198.51.100.7", "203.0.113.9", "curl/7.0", nil, []string{bindIP, bindSubnet, bindUserAgent, bindTLSCert}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := newSessionBinding(test.characteristics, bindingEnforce, 24, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session := sessions.NewSession(nil, "proxy-session")
+			if test.loginIP != "" {
+				login := httptest.NewRequest(http.MethodGet, "/", nil)
+				login.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+				session.Values[sessionClientIP] = test.loginIP
+				session.Values[sessionUserAgent] = "browser/1.0"
+				session.Values[sessionCertFingerprint] = certFingerprint(login)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("User-Agent", test.userAgent)
+			if test.cert != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+			} else {
+				r.TLS = nil
+			}
+
+			if got := b.mismatches(r, session, test.ip); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckBinding(t *testing.T) {
+	session := sessions.NewSession(nil, "proxy-session")
+	session.Values[sessionKey] = "alice"
+	session.Values[sessionClientIP] = "198.51.100.7"
+	session.Values[sessionUserAgent] = "browser/1.0"
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "198.51.100.7:1234"
+	r.Header.Set("User-Agent", "curl/7.0")
+
+	for _, policy := range []string{bindingEnforce, bindingAudit} {
+		b, err := newSessionBinding([]string{bindIP, bindUserAgent}, policy, 24, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = (&CASProxy{binding: b}).checkBinding(r, session)
+		if policy == bindingAudit && err != nil {
+			t.Errorf("expected mismatches to only be logged when auditing, got %s", err)
+		}
+		if policy == bindingEnforce && (err == nil || !strings.Contains(err.Error(), bindUserAgent)) {
+			t.Errorf("expected a user agent mismatch, got %v", err)
+		}
+	}
+
+	if err := (&CASProxy{}).checkBinding(r, session); err != nil {
+		t.Errorf("expected sessions not to be bound by default, got %s", err)
+	}
+}
+
+func TestNewSessionBinding(t *testing.T) {
+	tests := []struct {
+		name            string
+		characteristics []string
+		policy          string
+		ipv4, ipv6      int
+		err             string
+	}{
+		{"unknown characteristic", []string{"cookie"}, bindingEnforce, 24, 64, "--session-binding must be"},
+		{"unknown policy", []string{bindIP}, "warn", 24, 64, "--session-binding-policy must be"},
+		{"IPv4 prefix", []string{bindSubnet}, bindingEnforce, 33, 64, "--session-binding-ipv4-prefix"},
+		{"IPv6 prefix", []string{bindSubnet}, bindingEnforce, 24, -1, "--session-binding-ipv6-prefix"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newSessionBinding(test.characteristics, test.policy, test.ipv4, test.ipv6)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	if b, err := newSessionBinding(nil, bindingEnforce, 24, 64); b != nil || err != nil {
+		t.Errorf("expected no binding without characteristics, got %v, %v", b, err)
+	}
+}
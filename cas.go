@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// The CAS protocol versions that the proxy knows how to validate tickets with.
+const (
+	casProtocol1 = "1.0"
+	casProtocol2 = "2.0"
+	casProtocol3 = "3.0"
+)
+
+// casValidatePaths maps each protocol version to the default path of its
+// ticket validation endpoint, relative to the CAS base URL.
+var casValidatePaths = map[string]string{
+	casProtocol1:      "validate",
+	casProtocol2:      "serviceValidate",
+	casProtocol3:      "p3/serviceValidate",
+	casProtocolSAML11: "samlValidate",
+}
+
+func init() {
+	// Released attributes get stored in the session, which gob-encodes its
+	// values.
+	gob.Register(map[string][]string{})
+}
+
+// CASConfig contains the settings for a CASAuthenticator.
+type CASConfig struct {
+	BaseURL        string           // The base URL for the CAS server.
+	Validate       string           // The path to the validation endpoint on the CAS server.
+	Protocol       string           // The CAS protocol version used to validate tickets.
+	ClockSkew      time.Duration    // The clock skew allowed when checking SAML assertion conditions.
+	ProxyTickets   bool             // Whether to request proxy-granting tickets.
+	ProxyTargets   listFlags        // The services that the backend can get proxy tickets for.
+	ProxySecret    string           // Path to the file with the secret the backend sends to get proxy tickets.
+	AllowedProxies listFlags        // The services that may proxy requests to this one.
+	FrontendURL    string           // The URL placed into service query param for CAS.
+	ReservedPrefix string           // The path prefix for endpoints handled by the proxy itself.
+	RenewMaxAge    time.Duration    // How long a renewed login counts as recent.
+	LoginStates    *loginStateStore // Binds tickets to the browser that started the login.
+}
+
+// AddFlags adds the command-line flags for the CAS settings to the flag set.
+// The settings shared with the rest of the proxy aren't included.
+func (cfg *CASConfig) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.BaseURL, "cas-base-url", "", "The base URL to the CAS host.")
+	fs.StringVar(&cfg.Validate, "cas-validate", "", "The CAS URL endpoint for validating tickets. Defaults to the endpoint for --cas-protocol.")
+	fs.StringVar(&cfg.Protocol, "cas-protocol", casProtocol1, "The CAS protocol version to validate tickets with. One of 1.0, 2.0, 3.0, or saml1.1.")
+	fs.BoolVar(&cfg.ProxyTickets, "proxy-tickets", false, "Request proxy-granting tickets so that the backend can get proxy tickets for other services. Requires --cas-protocol 2.0 or 3.0 and an https --frontend-url.")
+	fs.Var(&cfg.ProxyTargets, "proxy-ticket-targets", "List of the services, separated by commas, that the backend can get proxy tickets for. A service that ends in a slash also allows the URLs beneath it. Required with --proxy-tickets.")
+	fs.StringVar(&cfg.ProxySecret, "proxy-ticket-secret-file", "", "Path to a file containing the secret that the backend must send in the "+proxyTicketSecretHeader+" header to get proxy tickets. Defaults to $"+proxyTicketSecretEnv+". Required with --proxy-tickets.")
+	fs.Var(&cfg.AllowedProxies, "allowed-proxies", "List of services allowed to proxy requests to this one, separated by commas.")
+}
+
+// CASAuthenticator is the Authenticator that logs users in with a CAS server.
+type CASAuthenticator struct {
+	casBase        string           // base URL for the CAS server
+	casValidate    string           // The path to the validation endpoint on the CAS server.
+	casProtocol    string           // The CAS protocol version used to validate tickets.
+	clockSkew      time.Duration    // The clock skew allowed when checking SAML assertion conditions.
+	pgtURL         string           // The callback URL for proxy-granting tickets. Empty if they're disabled.
+	proxyTargets   []string         // The services that the backend can get proxy tickets for.
+	proxySecret    []byte           // The secret that the backend sends to get proxy tickets.
+	allowedProxies []string         // The services that may proxy requests to this one.
+	frontendURL    string           // The URL placed into service query param for CAS.
+	reservedPrefix string           // The path prefix for endpoints handled by the proxy itself.
+	renewMaxAge    time.Duration    // How long a renewed login counts as recent.
+	loginStates    *loginStateStore // Nil if tickets aren't checked against a login state.
+	pgts           *pgtStore
+}
+
+// NewCASAuthenticator returns a newly instantiated *CASAuthenticator after
+// checking the configuration.
+func NewCASAuthenticator(cfg *CASConfig) (*CASAuthenticator, error) {
+	if cfg.BaseURL == "" {
+		return nil, errors.New("--cas-base-url must be set")
+	}
+
+	if _, ok := casValidatePaths[cfg.Protocol]; !ok {
+		return nil, fmt.Errorf("--cas-protocol must be one of 1.0, 2.0, 3.0, or saml1.1, not %s", cfg.Protocol)
+	}
+
+	if cfg.ProxyTickets {
+		if _, ok := casProxyValidatePaths[cfg.Protocol]; !ok {
+			return nil, errors.New("--proxy-tickets requires --cas-protocol 2.0 or 3.0")
+		}
+	}
+
+	validate := cfg.Validate
+	if validate == "" {
+		if cfg.ProxyTickets {
+			validate = casProxyValidatePaths[cfg.Protocol]
+		} else {
+			validate = casValidatePaths[cfg.Protocol]
+		}
+	}
+
+	a := &CASAuthenticator{
+		casBase:        cfg.BaseURL,
+		casValidate:    validate,
+		casProtocol:    cfg.Protocol,
+		clockSkew:      cfg.ClockSkew,
+		allowedProxies: cfg.AllowedProxies,
+		frontendURL:    cfg.FrontendURL,
+		reservedPrefix: cfg.ReservedPrefix,
+		renewMaxAge:    cfg.RenewMaxAge,
+		loginStates:    cfg.LoginStates,
+		pgts:           newPGTStore(),
+	}
+
+	if cfg.ProxyTickets {
+		pgtURL, err := a.pgtCallbackURL()
+		if err != nil {
+			return nil, err
+		}
+		a.pgtURL = pgtURL
+
+		if len(cfg.ProxyTargets) == 0 {
+			return nil, errors.New("--proxy-tickets requires --proxy-ticket-targets")
+		}
+		a.proxyTargets = cfg.ProxyTargets
+
+		if a.proxySecret, err = loadSecret(cfg.ProxySecret, proxyTicketSecretEnv); err != nil {
+			return nil, errors.Wrap(err, "failed to read the proxy ticket secret")
+		}
+		if len(a.proxySecret) == 0 {
+			return nil, errors.New("--proxy-tickets requires a secret in --proxy-ticket-secret-file or $" + proxyTicketSecretEnv)
+		}
+	}
+
+	log.Infof("CAS base URL is %s", a.casBase)
+	log.Infof("CAS protocol version is %s", a.casProtocol)
+	log.Infof("CAS ticket validator endpoint is %s", a.casValidate)
+	if a.pgtURL != "" {
+		log.Infof("proxy-granting ticket callback URL is %s", a.pgtURL)
+	}
+
+	return a, nil
+}
+
+// Routes adds the endpoints for CAS single logout and proxy-granting tickets.
+func (a *CASAuthenticator) Routes(r *mux.Router, p *CASProxy) {
+	if a.pgtURL != "" {
+		r.Path(path.Join(a.reservedPrefix, pgtCallbackPath)).HandlerFunc(a.PGTCallback)
+		r.Path(path.Join(a.reservedPrefix, proxyTicketPath)).Handler(a.ProxyTicket(p))
+	}
+	r.PathPrefix("/").MatcherFunc(a.IsLogoutRequest).Handler(a.SingleLogout(p))
+}
+
+// IsCallback returns true if the request has a ticket in the query params.
+func (a *CASAuthenticator) IsCallback(r *http.Request) bool {
+	_, ok := r.URL.Query()["ticket"]
+	return ok
+}
+
+// serviceURL returns the URL for the request as CAS sees it, which is the
+// frontend URL with the path and query params of the incoming request. The
+// ticket is removed from the query params, since redirection loops occur
+// otherwise.
+func (a *CASAuthenticator) serviceURL(r *http.Request) (*url.URL, error) {
+	svcURL, err := url.Parse(a.frontendURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the frontend URL %s", a.frontendURL)
+	}
+
+	svcURL.Path = r.URL.Path
+	sq := r.URL.Query()
+	sq.Del("ticket")
+	svcURL.RawQuery = sq.Encode()
+	return svcURL, nil
+}
+
+// Callback checks that the login was started in the same browser and
+// validates the ticket in the request against the configured CAS server.
+func (a *CASAuthenticator) Callback(w http.ResponseWriter, r *http.Request, opts LoginOptions) (*Identity, string, error) {
+	// Make sure the service in the CAS params is the same as the one that was
+	// requested.
+	svcURL, err := a.serviceURL(r)
+	if err != nil {
+		return nil, "", err
+	}
+	service := svcURL.String()
+
+	// The login state's nonce is part of the service URL that the ticket was
+	// issued for, but the user is sent back to the URL without it. If the
+	// state doesn't match, the ticket is thrown away and the user logs in
+	// again, unless that already happened once.
+	if a.loginStates != nil {
+		q := svcURL.Query()
+		nonce := q.Get(loginStateParam)
+		q.Del(loginStateParam)
+		svcURL.RawQuery = q.Encode()
+		if err = a.loginStates.Finish(w, r, nonce, svcURL.String()); err != nil {
+			if q.Get(loginRetryParam) != "" {
+				return nil, "", errors.Wrap(err, "login state check failed")
+			}
+			log.Infof("restarting the login: %s", err)
+			q.Set(loginRetryParam, "1")
+			svcURL.RawQuery = q.Encode()
+			return nil, svcURL.String(), ErrRestartLogin
+		}
+		q.Del(loginRetryParam)
+		svcURL.RawQuery = q.Encode()
+	}
+
+	// Proxy-granting tickets are only accepted while a validation is waiting
+	// for one.
+	if a.pgtURL != "" {
+		done := a.pgts.Expect()
+		defer done()
+	}
+
+	ticket := r.URL.Query().Get("ticket")
+	user, err := a.validateTicket(service, ticket, opts.ForceReauth, a.pgtURL != "")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "ticket validation failed")
+	}
+
+	if err = a.checkProxies(user.Proxies); err != nil {
+		return nil, "", errors.Wrap(err, "ticket validation failed")
+	}
+
+	id := &Identity{
+		Username:        user.Username,
+		Attributes:      user.Attributes,
+		SessionIndex:    ticket,
+		Reauthenticated: opts.ForceReauth,
+		Extra:           map[string]string{},
+	}
+
+	if user.PGTIOU != "" {
+		if pgt, ok := a.pgts.Take(user.PGTIOU); ok {
+			id.Extra[sessionPGT] = pgt
+		} else {
+			log.Warnf("no proxy-granting ticket was received for PGTIOU %s", user.PGTIOU)
+		}
+	}
+
+	return id, svcURL.String(), nil
+}
+
+// LoginRedirect redirects the request to CAS, setting the service query
+// parameter to the value in frontendURL. The login state cookie is set first
+// and its nonce is added to the service URL.
+func (a *CASAuthenticator) LoginRedirect(w http.ResponseWriter, r *http.Request, opts LoginOptions) {
+	casURL, err := url.Parse(a.casBase)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse CAS base URL %s", a.casBase)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Make sure the path in the CAS params is the same as the one that was
+	// requested.
+	svcURL, err := url.Parse(a.frontendURL)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse the frontend URL %s", a.frontendURL)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Make sure the serivce path and the query params are set to the incoming
+	// requests values for those fields.
+	svcURL.Path = r.URL.Path
+	svcURL.RawQuery = r.URL.RawQuery
+
+	if a.loginStates != nil {
+		sq := r.URL.Query()
+		sq.Del(loginStateParam)
+		svcURL.RawQuery = sq.Encode()
+
+		nonce, err := a.loginStates.Start(w, r, svcURL.String())
+		if err != nil {
+			err = errors.Wrap(err, "failed to start the login")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sq.Set(loginStateParam, nonce)
+		svcURL.RawQuery = sq.Encode()
+	}
+
+	//set the service query param in the casURL.
+	q := casURL.Query()
+	q.Add("service", svcURL.String())
+
+	// Renewing makes the user log in again even if there's a single sign-on
+	// session. In gateway mode, CAS sends the user back without a ticket if
+	// there's no single sign-on session already.
+	if opts.ForceReauth {
+		q.Add("renew", "true")
+	} else if opts.Passive {
+		q.Add("gateway", "true")
+	}
+	casURL.RawQuery = q.Encode()
+	casURL.Path = path.Join(casURL.Path, "login")
+
+	// perform the redirect
+	http.Redirect(w, r, casURL.String(), http.StatusTemporaryRedirect)
+}
+
+// LogoutURL returns the URL for the CAS logout page. Service URLs that aren't
+// under the frontend URL are left out, so that CAS can't be used to redirect
+// anywhere.
+func (a *CASAuthenticator) LogoutURL(service string) (string, error) {
+	casURL, err := url.Parse(a.casBase)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse CAS base URL %s", a.casBase)
+	}
+
+	casURL.Path = path.Join(casURL.Path, "logout")
+	service = checkLogoutService(service, a.frontendURL)
+	if service != "" {
+		q := casURL.Query()
+		q.Add("service", service)
+		casURL.RawQuery = q.Encode()
+	}
+	return casURL.String(), nil
+}
+
+// CASUser is the identity returned by the CAS server after a successful ticket
+// validation.
+type CASUser struct {
+	Username   string
+	Attributes map[string][]string
+	PGTIOU     string   // Refers to the proxy-granting ticket sent to the callback.
+	Proxies    []string // The proxy chain, if the ticket was a proxy ticket.
+
+	// When the user logged in. Only SAML 1.1 responses include this.
+	AuthenticatedAt time.Time
+}
+
+// casServiceResponse is the XML document returned by the serviceValidate
+// endpoints in versions 2.0 and 3.0 of the CAS protocol.
+type casServiceResponse struct {
+	XMLName xml.Name        `xml:"serviceResponse"`
+	Success *casAuthSuccess `xml:"authenticationSuccess"`
+	Failure *casAuthFailure `xml:"authenticationFailure"`
+}
+
+type casAuthSuccess struct {
+	User       string        `xml:"user"`
+	Attributes casAttributes `xml:"attributes"`
+	PGTIOU     string        `xml:"proxyGrantingTicket"`
+	Proxies    []string      `xml:"proxies>proxy"`
+}
+
+type casAuthFailure struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// casAttributes collects the arbitrarily named elements inside of the
+// cas:attributes element.
+type casAttributes struct {
+	Values []casAttribute `xml:",any"`
+}
+
+type casAttribute struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// Map returns the attributes keyed by their local name. Multi-valued
+// attributes are released as repeated elements, so each name can have more
+// than one value.
+func (a casAttributes) Map() map[string][]string {
+	m := map[string][]string{}
+	for _, attr := range a.Values {
+		m[attr.XMLName.Local] = append(m[attr.XMLName.Local], strings.TrimSpace(attr.Value))
+	}
+	return m
+}
+
+// validateTicket asks the CAS server whether the ticket is valid for the
+// service and returns the user that it was issued to. If renew is true, the
+// ticket must have come from a primary login rather than a single sign-on
+// session. If requestPGT is true, CAS is asked to send a proxy-granting ticket
+// to the callback endpoint.
+func (a *CASAuthenticator) validateTicket(service, ticket string, renew, requestPGT bool) (*CASUser, error) {
+	if a.casProtocol == casProtocolSAML11 {
+		return a.validateSAMLTicket(service, ticket, renew)
+	}
+
+	casURL, err := url.Parse(a.casBase)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse CAS base URL %s", a.casBase)
+	}
+
+	// The request URL for CAS ticket validation needs to have the service and
+	// ticket in it.
+	casURL.Path = path.Join(casURL.Path, a.casValidate)
+	q := casURL.Query()
+	q.Add("service", service)
+	q.Add("ticket", ticket)
+	if renew {
+		q.Add("renew", "true")
+	}
+	if requestPGT {
+		q.Add("pgtUrl", a.pgtURL)
+	}
+	casURL.RawQuery = q.Encode()
+
+	// Actually validate the ticket.
+	resp, err := http.Get(casURL.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "ticket validation error")
+	}
+	defer resp.Body.Close()
+
+	// If this happens then something went wrong on the CAS side of things. Doesn't
+	// mean the ticket is invalid, just that the CAS server is in a state where
+	// we can't trust the response.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("ticket validation status code was %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading body of CAS response")
+	}
+
+	if a.casProtocol == casProtocol1 {
+		return parseCAS1Response(b)
+	}
+	return parseServiceResponse(b)
+}
+
+// parseCAS1Response parses the plain-text body returned by the CAS 1.0
+// validate endpoint.
+func parseCAS1Response(b []byte) (*CASUser, error) {
+	// This is where the actual ticket validation happens. If the CAS server
+	// returns 'no\n\n' in the body, then the validation was not successful. The
+	// HTTP status code will be in the 200 range regardless of the validation
+	// status.
+	if bytes.Equal(b, []byte("no\n\n")) {
+		return nil, fmt.Errorf("ticket validation response body was %s", b)
+	}
+
+	fields := bytes.Fields(b)
+	if len(fields) < 2 {
+		return nil, errors.New("not enough fields in ticket validation response body")
+	}
+
+	if string(fields[0]) != "yes" {
+		return nil, fmt.Errorf("ticket validation response body was %s", b)
+	}
+
+	return &CASUser{
+		Username:   string(fields[1]),
+		Attributes: map[string][]string{},
+	}, nil
+}
+
+// parseServiceResponse parses the cas:serviceResponse XML document returned by
+// the CAS 2.0 and 3.0 validation endpoints.
+func parseServiceResponse(b []byte) (*CASUser, error) {
+	sr := &casServiceResponse{}
+	if err := xml.Unmarshal(b, sr); err != nil {
+		return nil, errors.Wrap(err, "error parsing CAS service response")
+	}
+
+	if sr.Failure != nil {
+		return nil, fmt.Errorf("CAS returned %s: %s", sr.Failure.Code, strings.TrimSpace(sr.Failure.Message))
+	}
+
+	if sr.Success == nil {
+		return nil, errors.New("CAS service response did not indicate success or failure")
+	}
+
+	username := strings.TrimSpace(sr.Success.User)
+	if username == "" {
+		return nil, errors.New("CAS service response did not contain a user")
+	}
+
+	proxies := []string{}
+	for _, p := range sr.Success.Proxies {
+		proxies = append(proxies, strings.TrimSpace(p))
+	}
+
+	return &CASUser{
+		Username:   username,
+		Attributes: sr.Success.Attributes.Map(),
+		PGTIOU:     strings.TrimSpace(sr.Success.PGTIOU),
+		Proxies:    proxies,
+	}, nil
+}
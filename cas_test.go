@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCAS1Response(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		username string
+		err      string
+	}{
+		{"success", "yes\nalice\n", "alice", ""},
+		{"failure", "no\n\n", "", "ticket validation response body was"},
+		{"missing user", "yes\n", "", "not enough fields"},
+		{"unexpected answer", "maybe\nalice\n", "", "ticket validation response body was"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := parseCAS1Response([]byte(test.body))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Username != test.username {
+				t.Errorf("expected user %s, got %s", test.username, user.Username)
+			}
+		})
+	}
+}
+
+func TestParseServiceResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		user *CASUser
+		err  string
+	}{
+		{
+			name: "CAS 2.0 success",
+			body: `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess>
+    <cas:user>alice</cas:user>
+  </cas:authenticationSuccess>
+</cas:serviceResponse>`,
+			user: &CASUser{
+				Username:   "alice",
+				Attributes: map[string][]string{},
+				Proxies:    []string{},
+			},
+		},
+		{
+			name: "CAS 3.0 attributes",
+			body: `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess>
+    <cas:user> alice </cas:user>
+    <cas:attributes>
+      <cas:email>alice@example.org</cas:email>
+      <cas:memberOf>cn=g1,ou=groups</cas:memberOf>
+      <cas:memberOf>cn=g2,ou=groups</cas:memberOf>
+    </cas:attributes>
+  </cas:authenticationSuccess>
+</cas:serviceResponse>`,
+			user: &CASUser{
+				Username: "alice",
+				Attributes: map[string][]string{
+					"email":    {"alice@example.org"},
+					"memberOf": {"cn=g1,ou=groups", "cn=g2,ou=groups"},
+				},
+				Proxies: []string{},
+			},
+		},
+		{
+			name: "proxy ticket",
+			body: `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess>
+    <cas:user>alice</cas:user>
+    <cas:proxyGrantingTicket>PGTIOU-1</cas:proxyGrantingTicket>
+    <cas:proxies>
+      <cas:proxy>https://a.example.org/cb</cas:proxy>
+      <cas:proxy>https://b.example.org/cb</cas:proxy>
+    </cas:proxies>
+  </cas:authenticationSuccess>
+</cas:serviceResponse>`,
+			user: &CASUser{
+				Username:   "alice",
+				Attributes: map[string][]string{},
+				PGTIOU:     "PGTIOU-1",
+				Proxies:    []string{"https://a.example.org/cb", "https://b.example.org/cb"},
+			},
+		},
+		{
+			name: "failure",
+			body: `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationFailure code="INVALID_TICKET">
+    Ticket ST-1 not recognized
+  </cas:authenticationFailure>
+</cas:serviceResponse>`,
+			err: "CAS returned INVALID_TICKET: Ticket ST-1 not recognized",
+		},
+		{
+			name: "neither success nor failure",
+			body: `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"/>`,
+			err:  "did not indicate success or failure",
+		},
+		{
+			name: "empty user",
+			body: `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess><cas:user> </cas:user></cas:authenticationSuccess>
+</cas:serviceResponse>`,
+			err: "did not contain a user",
+		},
+		{
+			name: "not XML",
+			body: "yes\nalice\n",
+			err:  "error parsing CAS service response",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := parseServiceResponse([]byte(test.body))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(user, test.user) {
+				t.Errorf("expected %+v, got %+v", test.user, user)
+			}
+		})
+	}
+}
+
+func TestCASLogoutURL(t *testing.T) {
+	a := &CASAuthenticator{
+		casBase:     "https://cas.example.org/cas",
+		frontendURL: "https://proxy.example.org/app",
+	}
+
+	tests := []struct {
+		name    string
+		service string
+		want    string
+	}{
+		{"no service", "", "https://cas.example.org/cas/logout"},
+		{"service under the frontend URL", "https://proxy.example.org/app/bye", "https://cas.example.org/cas/logout?service=https%3A%2F%2Fproxy.example.org%2Fapp%2Fbye"},
+		{"foreign service", "https://evil.example.org/", "https://cas.example.org/cas/logout"},
+		{"look-alike host", "https://proxy.example.org.evil.example.org/app/", "https://cas.example.org/cas/logout"},
+		{"sibling path", "https://proxy.example.org/application", "https://cas.example.org/cas/logout"},
+		{"other scheme", "http://proxy.example.org/app/", "https://cas.example.org/cas/logout"},
+		{"user info", "https://proxy.example.org@evil.example.org/app/", "https://cas.example.org/cas/logout"},
+		{"escaping the path", "https://proxy.example.org/app/../admin", "https://cas.example.org/cas/logout"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := a.LogoutURL(test.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PasswordLogin logs the user in with the CAS REST protocol. The credentials
+// are exchanged for a ticket-granting ticket, which is exchanged for a service
+// ticket for the frontend URL. The service ticket is then validated the same
+// way as one from a browser login. The ticket-granting ticket is destroyed
+// afterwards, since the proxy caches the result instead of reusing it.
+func (a *CASAuthenticator) PasswordLogin(username, password string) (*Identity, error) {
+	tgtURL, err := a.requestTGT(username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer a.destroyTGT(tgtURL)
+
+	ticket, err := a.requestServiceTicket(tgtURL, a.frontendURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The proxy-granting ticket would only be kept in a session, which
+	// password logins don't have.
+	user, err := a.validateTicket(a.frontendURL, ticket, false, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "ticket validation failed")
+	}
+
+	return &Identity{
+		Username:   user.Username,
+		Attributes: user.Attributes,
+	}, nil
+}
+
+// requestTGT posts the credentials to the v1/tickets endpoint and returns the
+// URL of the ticket-granting ticket that CAS created.
+func (a *CASAuthenticator) requestTGT(username, password string) (string, error) {
+	casURL, err := url.Parse(a.casBase)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse CAS base URL %s", a.casBase)
+	}
+	casURL.Path = path.Join(casURL.Path, "v1", "tickets")
+
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
+
+	resp, err := http.PostForm(casURL.String(), form)
+	if err != nil {
+		return "", errors.Wrap(err, "ticket-granting ticket request error")
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized:
+		return "", errors.New("CAS rejected the credentials")
+	case resp.StatusCode != http.StatusCreated:
+		return "", fmt.Errorf("ticket-granting ticket request status code was %d", resp.StatusCode)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", errors.Wrap(err, "CAS did not return the location of the ticket-granting ticket")
+	}
+	return location.String(), nil
+}
+
+// requestServiceTicket asks for a service ticket for the service with the
+// ticket-granting ticket at tgtURL.
+func (a *CASAuthenticator) requestServiceTicket(tgtURL, service string) (string, error) {
+	form := url.Values{}
+	form.Set("service", service)
+
+	resp, err := http.PostForm(tgtURL, form)
+	if err != nil {
+		return "", errors.Wrap(err, "service ticket request error")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("service ticket request status code was %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading body of CAS response")
+	}
+
+	ticket := strings.TrimSpace(string(b))
+	if ticket == "" {
+		return "", errors.New("CAS did not return a service ticket")
+	}
+	return ticket, nil
+}
+
+// destroyTGT ends the single sign-on session created by requestTGT. Failures
+// are only logged, since the ticket-granting ticket expires on its own.
+func (a *CASAuthenticator) destroyTGT(tgtURL string) {
+	req, err := http.NewRequest(http.MethodDelete, tgtURL, nil)
+	if err != nil {
+		log.Error(errors.Wrap(err, "failed to create ticket-granting ticket deletion request"))
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error(errors.Wrap(err, "failed to delete ticket-granting ticket"))
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordLogin(t *testing.T) {
+	c := newTestCAS(t)
+	defer c.Close()
+	a := newTestPGTAuthenticator(c)
+
+	id, err := a.PasswordLogin("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Username != "alice" {
+		t.Errorf("expected alice, got %s", id.Username)
+	}
+
+	// Password logins don't have a session to keep a proxy-granting ticket
+	// in, and don't leave a single sign-on session behind.
+	if len(c.pgtURLs) != 1 || c.pgtURLs[0] != "" {
+		t.Errorf("expected the validation not to ask for a proxy-granting ticket, got %q", c.pgtURLs)
+	}
+	if len(c.destroyed) != 1 {
+		t.Errorf("expected the ticket-granting ticket to be destroyed, got %v", c.destroyed)
+	}
+
+	for _, password := range []string{"wrong", ""} {
+		if _, err = a.PasswordLogin("alice", password); err == nil || !strings.Contains(err.Error(), "rejected the credentials") {
+			t.Errorf("expected the password %q to be rejected, got %v", password, err)
+		}
+	}
+	if len(c.pgtURLs) != 1 {
+		t.Errorf("expected rejected credentials not to get as far as validation, got %d validations", len(c.pgtURLs))
+	}
+}
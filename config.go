@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadConfig sets flags from the JSON object in the file at configPath. The
+// keys are flag names without the leading dashes. Lists can be given either
+// as arrays or as comma-separated strings. Flags that were set on the command
+// line take precedence over the file.
+func loadConfig(fs *flag.FlagSet, configPath string) error {
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read config file %s", configPath)
+	}
+
+	cfg := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&cfg); err != nil {
+		return errors.Wrapf(err, "failed to parse config file %s", configPath)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, value := range cfg {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s in config file %s", name, configPath)
+		}
+
+		if set[name] {
+			continue
+		}
+
+		var s string
+		switch v := value.(type) {
+		case []interface{}:
+			parts := []string{}
+			for _, p := range v {
+				parts = append(parts, fmt.Sprint(p))
+			}
+			s = strings.Join(parts, ",")
+		default:
+			s = fmt.Sprint(v)
+		}
+
+		if err = fs.Set(name, s); err != nil {
+			return errors.Wrapf(err, "invalid value for %s in config file %s", name, configPath)
+		}
+	}
+
+	return nil
+}
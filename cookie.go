@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// The values of --cookie-secure.
+const (
+	cookieSecureAuto   = "auto"
+	cookieSecureAlways = "always"
+	cookieSecureNever  = "never"
+)
+
+// cookieAttributes are the cookie attributes that sessions.Options doesn't
+// have, which the session stores add to every cookie they set.
+type cookieAttributes struct {
+	secure   string        // One of the cookieSecure constants.
+	sameSite http.SameSite // Zero leaves the attribute out.
+}
+
+// parseSameSite returns the SameSite mode for the value of --cookie-samesite.
+func parseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "", "default":
+		return 0, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("--cookie-samesite must be one of: lax, strict, none, default, not %s", s)
+}
+
+// newCookieAttributes checks the values of --cookie-secure and
+// --cookie-samesite. Browsers reject SameSite=None cookies that aren't
+// secure, so that combination is an error.
+func newCookieAttributes(secure, sameSite string) (cookieAttributes, error) {
+	switch secure {
+	case cookieSecureAuto, cookieSecureAlways, cookieSecureNever:
+	default:
+		return cookieAttributes{}, fmt.Errorf("--cookie-secure must be one of: auto, always, never, not %s", secure)
+	}
+
+	mode, err := parseSameSite(sameSite)
+	if err != nil {
+		return cookieAttributes{}, err
+	}
+	if mode == http.SameSiteNoneMode && secure == cookieSecureNever {
+		return cookieAttributes{}, fmt.Errorf("--cookie-samesite none requires secure cookies")
+	}
+
+	return cookieAttributes{secure: secure, sameSite: mode}, nil
+}
+
+// isHTTPS returns true if the request reached the proxy, or the load balancer
+// in front of it, over TLS.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// newCookie returns the cookie for the value with the session options and
+// the extra attributes. With --cookie-secure auto, the cookie is secure if the
+// request was made over HTTPS. SameSite=None cookies are always secure.
+func (a cookieAttributes) newCookie(r *http.Request, name, value string, opts *sessions.Options) *http.Cookie {
+	cookie := sessions.NewCookie(name, value, opts)
+	switch a.secure {
+	case cookieSecureAlways:
+		cookie.Secure = true
+	case cookieSecureAuto:
+		cookie.Secure = cookie.Secure || isHTTPS(r)
+	}
+	if a.sameSite == http.SameSiteNoneMode {
+		cookie.Secure = true
+	}
+	cookie.SameSite = a.sameSite
+	return cookie
+}
+
+// forRedirects returns the attributes for cookies that have to be sent with
+// the redirect back from the provider, which is a cross-site navigation.
+// Browsers don't send SameSite=Strict cookies with those, so they're Lax
+// instead, unless they're None.
+func (a cookieAttributes) forRedirects() cookieAttributes {
+	if a.sameSite != http.SameSiteNoneMode {
+		a.sameSite = http.SameSiteLaxMode
+	}
+	return a
+}
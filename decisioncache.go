@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// decisionKey identifies a permission decision.
+type decisionKey struct {
+	user     string
+	resource string
+}
+
+type decisionEntry struct {
+	key     decisionKey
+	level   string // The user's permission level. Empty if they have no access.
+	expires time.Time
+}
+
+// decisionCall is a lookup in progress, which concurrent lookups for the same
+// key wait for instead of making their own.
+type decisionCall struct {
+	done    chan struct{}
+	flushed bool // Set if the cache was flushed during the lookup, so its result isn't cached.
+	level   string
+	err     error
+}
+
+// decisionCache remembers permission decisions, which are the users' permission
+// levels, so that the permissions service isn't asked about every request.
+// Decisions that allow access and ones that deny it are kept for different
+// lengths of time, since a user who was just granted access shouldn't have to
+// wait as long. The least recently used decisions are dropped once the cache
+// is full. Errors aren't cached.
+type decisionCache struct {
+	allowTTL   time.Duration
+	denyTTL    time.Duration
+	maxEntries int
+
+	mutex    sync.Mutex
+	entries  map[decisionKey]*list.Element
+	order    *list.List // Most recently used first.
+	inFlight map[decisionKey]*decisionCall
+}
+
+func newDecisionCache(allowTTL, denyTTL time.Duration, maxEntries int) *decisionCache {
+	return &decisionCache{
+		allowTTL:   allowTTL,
+		denyTTL:    denyTTL,
+		maxEntries: maxEntries,
+		entries:    map[decisionKey]*list.Element{},
+		order:      list.New(),
+		inFlight:   map[decisionKey]*decisionCall{},
+	}
+}
+
+// Get returns the cached permission level for the user and resource, calling
+// lookup to get it if there isn't one. Only one lookup runs at a time for each
+// key.
+func (d *decisionCache) Get(user, resource string, lookup func() (string, error)) (string, error) {
+	key := decisionKey{user: user, resource: resource}
+
+	d.mutex.Lock()
+	if e, ok := d.entries[key]; ok {
+		entry := e.Value.(*decisionEntry)
+		if time.Now().Before(entry.expires) {
+			d.order.MoveToFront(e)
+			d.mutex.Unlock()
+			return entry.level, nil
+		}
+		d.removeElement(e)
+	}
+
+	if call, ok := d.inFlight[key]; ok {
+		d.mutex.Unlock()
+		<-call.done
+		return call.level, call.err
+	}
+
+	call := &decisionCall{
+		done: make(chan struct{}),
+	}
+	d.inFlight[key] = call
+	d.mutex.Unlock()
+
+	call.level, call.err = lookup()
+
+	d.mutex.Lock()
+	if d.inFlight[key] == call {
+		delete(d.inFlight, key)
+	}
+	if call.err == nil && !call.flushed {
+		d.put(key, call.level)
+	}
+	d.mutex.Unlock()
+	close(call.done)
+
+	return call.level, call.err
+}
+
+// put adds the decision to the cache, evicting the least recently used one if
+// the cache is full. The mutex must be held.
+func (d *decisionCache) put(key decisionKey, level string) {
+	ttl := d.denyTTL
+	if level != "" {
+		ttl = d.allowTTL
+	}
+	if ttl <= 0 || d.maxEntries <= 0 {
+		return
+	}
+
+	entry := &decisionEntry{
+		key:     key,
+		level:   level,
+		expires: time.Now().Add(ttl),
+	}
+	if e, ok := d.entries[key]; ok {
+		e.Value = entry
+		d.order.MoveToFront(e)
+		return
+	}
+
+	d.entries[key] = d.order.PushFront(entry)
+	for d.order.Len() > d.maxEntries {
+		d.removeElement(d.order.Back())
+	}
+}
+
+// removeElement removes the entry from the cache. The mutex must be held.
+func (d *decisionCache) removeElement(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.entries, e.Value.(*decisionEntry).key)
+}
+
+// Flush removes the cached decisions for the user, or all of them if the user
+// is empty, and returns how many were removed. The results of lookups that are
+// already in progress aren't cached, since they might be out of date as well,
+// and later calls to Get make new lookups instead of waiting for them.
+func (d *decisionCache) Flush(user string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for key, call := range d.inFlight {
+		if user == "" || key.user == user {
+			call.flushed = true
+			delete(d.inFlight, key)
+		}
+	}
+
+	if user == "" {
+		n := d.order.Len()
+		d.entries = map[decisionKey]*list.Element{}
+		d.order.Init()
+		return n
+	}
+
+	n := 0
+	for key, e := range d.entries {
+		if key.user == user {
+			d.removeElement(e)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// constantLookup returns a lookup that counts its calls and returns the level.
+func constantLookup(calls *int32, level string) func() (string, error) {
+	return func() (string, error) {
+		atomic.AddInt32(calls, 1)
+		return level, nil
+	}
+}
+
+func TestDecisionCacheCollapsesLookups(t *testing.T) {
+	d := newDecisionCache(time.Minute, time.Minute, 10)
+
+	var calls int32
+	release := make(chan struct{})
+	lookup := func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "write", nil
+	}
+
+	// The first lookup blocks until every caller is waiting for it.
+	const callers = 10
+	var started, finished sync.WaitGroup
+	levels := make(chan string, callers)
+	for i := 0; i < callers; i++ {
+		started.Add(1)
+		finished.Add(1)
+		go func() {
+			defer finished.Done()
+			started.Done()
+			level, err := d.Get("alice", "analysis", lookup)
+			if err != nil {
+				t.Error(err)
+			}
+			levels <- level
+		}()
+	}
+	started.Wait()
+	for {
+		d.mutex.Lock()
+		_, ok := d.inFlight[decisionKey{"alice", "analysis"}]
+		d.mutex.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	finished.Wait()
+	close(levels)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected concurrent misses to make 1 lookup, got %d", n)
+	}
+	for level := range levels {
+		if level != "write" {
+			t.Errorf("expected every caller to get write, got %q", level)
+		}
+	}
+}
+
+func TestDecisionCacheTTLs(t *testing.T) {
+	d := newDecisionCache(time.Minute, time.Minute, 10)
+	var calls int32
+
+	d.Get("alice", "analysis", constantLookup(&calls, "read"))
+	d.Get("bob", "analysis", constantLookup(&calls, ""))
+	level, _ := d.Get("alice", "analysis", constantLookup(&calls, "own"))
+	d.Get("bob", "analysis", constantLookup(&calls, ""))
+	if n := atomic.LoadInt32(&calls); n != 2 || level != "read" {
+		t.Fatalf("expected allow and deny decisions to be cached, got %d lookups and %q", n, level)
+	}
+
+	// Expired decisions are looked up again.
+	for _, e := range d.entries {
+		e.Value.(*decisionEntry).expires = time.Now().Add(-time.Second)
+	}
+	level, _ = d.Get("alice", "analysis", constantLookup(&calls, "own"))
+	if n := atomic.LoadInt32(&calls); n != 3 || level != "own" {
+		t.Errorf("expected an expired decision to be looked up again, got %d lookups and %q", n, level)
+	}
+
+	// Allow and deny decisions have their own TTLs, and a zero TTL disables
+	// caching them.
+	d = newDecisionCache(time.Minute, 0, 10)
+	calls = 0
+	d.Get("alice", "analysis", constantLookup(&calls, "read"))
+	d.Get("alice", "analysis", constantLookup(&calls, "read"))
+	d.Get("bob", "analysis", constantLookup(&calls, ""))
+	d.Get("bob", "analysis", constantLookup(&calls, ""))
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("expected only the allow decision to be cached, got %d lookups", n)
+	}
+	if e, ok := d.entries[decisionKey{"alice", "analysis"}]; !ok || time.Until(e.Value.(*decisionEntry).expires) > time.Minute {
+		t.Error("expected the allow decision to last the allow TTL")
+	}
+}
+
+func TestDecisionCacheEviction(t *testing.T) {
+	d := newDecisionCache(time.Minute, time.Minute, 2)
+	var calls int32
+
+	d.Get("alice", "analysis", constantLookup(&calls, "read"))
+	d.Get("bob", "analysis", constantLookup(&calls, "read"))
+	d.Get("alice", "analysis", constantLookup(&calls, "read")) // Bob is now the least recently used.
+	d.Get("carol", "analysis", constantLookup(&calls, "read"))
+
+	if len(d.entries) != 2 || d.order.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d in the map and %d in the list", len(d.entries), d.order.Len())
+	}
+	if _, ok := d.entries[decisionKey{"bob", "analysis"}]; ok {
+		t.Error("expected the least recently used decision to be evicted")
+	}
+
+	calls = 0
+	d.Get("alice", "analysis", constantLookup(&calls, "read"))
+	d.Get("carol", "analysis", constantLookup(&calls, "read"))
+	d.Get("bob", "analysis", constantLookup(&calls, "read"))
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected only the evicted decision to be looked up, got %d lookups", n)
+	}
+}
+
+func TestDecisionCacheErrors(t *testing.T) {
+	d := newDecisionCache(time.Minute, time.Minute, 10)
+	var calls int32
+	failing := func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", errors.New("permissions service unavailable")
+	}
+
+	if _, err := d.Get("alice", "analysis", failing); err == nil {
+		t.Fatal("expected the lookup's error")
+	}
+	level, err := d.Get("alice", "analysis", constantLookup(&calls, "read"))
+	if err != nil || level != "read" {
+		t.Errorf("expected the lookup after an error to succeed, got %q, %v", level, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected the error not to be cached, got %d lookups", n)
+	}
+}
+
+func TestDecisionCacheFlush(t *testing.T) {
+	d := newDecisionCache(time.Minute, time.Minute, 10)
+	var calls int32
+	d.Get("alice", "a1", constantLookup(&calls, "read"))
+	d.Get("alice", "a2", constantLookup(&calls, "read"))
+	d.Get("bob", "a1", constantLookup(&calls, "read"))
+
+	if n := d.Flush("alice"); n != 2 {
+		t.Errorf("expected 2 of alice's decisions to be flushed, got %d", n)
+	}
+	if _, ok := d.entries[decisionKey{"bob", "a1"}]; !ok {
+		t.Error("expected bob's decision to be kept")
+	}
+	if n := d.Flush(""); n != 1 || d.order.Len() != 0 {
+		t.Errorf("expected the remaining decision to be flushed, got %d with %d left", n, d.order.Len())
+	}
+}
+
+func TestDecisionCacheFlushInFlight(t *testing.T) {
+	d := newDecisionCache(time.Minute, time.Minute, 10)
+
+	// A lookup that started before the flush returns the old level.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	stale := make(chan string)
+	go func() {
+		level, _ := d.Get("alice", "analysis", func() (string, error) {
+			close(started)
+			<-release
+			return "own", nil
+		})
+		stale <- level
+	}()
+	<-started
+
+	d.Flush("alice")
+
+	// Lookups after the flush don't wait for the one from before it.
+	var calls int32
+	level, err := d.Get("alice", "analysis", constantLookup(&calls, ""))
+	if err != nil || level != "" || calls != 1 {
+		t.Errorf("expected a new lookup after the flush, got %q, %v after %d lookups", level, err, calls)
+	}
+
+	close(release)
+	if level = <-stale; level != "own" {
+		t.Errorf("expected the lookup from before the flush to return own, got %q", level)
+	}
+
+	// The decision from after the flush is cached, and the one from before
+	// it isn't.
+	level, _ = d.Get("alice", "analysis", constantLookup(&calls, "own"))
+	if level != "" || calls != 1 {
+		t.Errorf("expected the decision from after the flush to be cached, got %q after %d lookups", level, calls)
+	}
+}
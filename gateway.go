@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// gatewayCookieName returns the name of the cookie that records that the
+// client was already sent to log in passively and came back without logging
+// in. It's derived from the session cookie's name, so that analyses on the
+// same domain don't see each other's.
+func (c *CASProxy) gatewayCookieName() string {
+	return c.sessionName + "-gateway"
+}
+
+// setGatewayCookie remembers that the client is being sent to log in
+// passively, so that it isn't sent again when the provider returns without
+// logging it in. It has the session cookie's attributes, except that it's
+// always sent with the redirect back from the provider.
+func (c *CASProxy) setGatewayCookie(w http.ResponseWriter, r *http.Request) {
+	opts := *c.cookies.Options
+	opts.MaxAge = int(c.gatewayMaxAge / time.Second)
+	http.SetCookie(w, c.cookies.attrs.forRedirects().newCookie(r, c.gatewayCookieName(), "1", &opts))
+}
+
+// Anonymous implements the mux.Matcher interface so that requests for gateway
+// paths from clients without a session can be forwarded to the backend
+// anonymously once the provider has reported that there's no single sign-on
+// session.
+func (c *CASProxy) Anonymous(r *http.Request, m *mux.RouteMatch) bool {
+	if !c.gatewayPaths.Match(r.URL.Path) {
+		return false
+	}
+
+	if _, err := r.Cookie(c.gatewayCookieName()); err != nil {
+		return false
+	}
+
+	return c.Session(r, m)
+}
+
+// AnonymousProxy returns a handler that forwards requests to the backend
+// without checking permissions or passing along any user identity. The nonce
+// and retry marker of a passive login that came back without a ticket are
+// removed first.
+func (c *CASProxy) AnonymousProxy() (http.Handler, error) {
+	backend, err := c.backend()
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get(loginStateParam) != "" || q.Get(loginRetryParam) != "" {
+			q.Del(loginStateParam)
+			q.Del(loginRetryParam)
+			r.URL.RawQuery = q.Encode()
+		}
+		backend.ServeHTTP(w, r)
+	}), nil
+}
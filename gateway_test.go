@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+func TestGatewayCookie(t *testing.T) {
+	pair, err := randomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newRotatingStore([]keyPair{pair}, &sessions.Options{Path: "/", MaxAge: 3600}, cookieAttributes{}, false)
+
+	// newProxy returns a proxy for the analysis, which shares the domain with
+	// the others.
+	newProxy := func(analysis string) *CASProxy {
+		return &CASProxy{
+			sessionName:   "proxy-session-" + analysis,
+			sessionStore:  store,
+			cookies:       store,
+			tickets:       newTicketIndex(0),
+			gatewayPaths:  pathPatterns{"/"},
+			gatewayMaxAge: time.Minute,
+		}
+	}
+	first, second := newProxy("a1"), newProxy("a2")
+
+	w := httptest.NewRecorder()
+	first.setGatewayCookie(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "proxy-session-a1-gateway" || cookies[0].MaxAge != 60 {
+		t.Fatalf("expected a gateway cookie for the first analysis, got %v", cookies)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	if !first.Anonymous(r, &mux.RouteMatch{}) {
+		t.Error("expected the first analysis to let the request through anonymously")
+	}
+	if second.Anonymous(r, &mux.RouteMatch{}) {
+		t.Error("expected the second analysis to send the user to log in")
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Registers SHA-256 for crypto.Hash.
+	_ "crypto/sha512" // Registers SHA-384 and SHA-512 for crypto.Hash.
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jwksRefreshInterval is the minimum amount of time between fetches of a JSON
+// Web Key Set, so that tokens with unknown key IDs can't be used to hammer the
+// server that hosts it.
+const jwksRefreshInterval = time.Minute
+
+// jwtAlgorithms maps the supported JWS signing algorithms to the hash they
+// use.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// jwtToken is a parsed, but not necessarily verified, JSON Web Token.
+type jwtToken struct {
+	header    jwtHeader
+	claims    map[string]interface{}
+	signed    []byte // The header and payload that the signature covers.
+	signature []byte
+}
+
+// parseJWT splits a compact-serialized JWT into its parts and decodes them.
+// The signature isn't checked.
+func parseJWT(raw string) (*jwtToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token does not have three parts")
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode token header")
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode token payload")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode token signature")
+	}
+
+	t := &jwtToken{
+		claims:    map[string]interface{}{},
+		signed:    []byte(parts[0] + "." + parts[1]),
+		signature: sig,
+	}
+
+	if err = json.Unmarshal(hb, &t.header); err != nil {
+		return nil, errors.Wrap(err, "failed to parse token header")
+	}
+
+	d := json.NewDecoder(bytes.NewReader(pb))
+	d.UseNumber()
+	if err = d.Decode(&t.claims); err != nil {
+		return nil, errors.Wrap(err, "failed to parse token payload")
+	}
+
+	return t, nil
+}
+
+// verify checks the token's signature with the public key.
+func (t *jwtToken) verify(key crypto.PublicKey) error {
+	hash, ok := jwtAlgorithms[t.header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported signing algorithm %s", t.header.Alg)
+	}
+
+	h := hash.New()
+	h.Write(t.signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch t.header.Alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, t.signature)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, t.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		if t.header.Alg[:2] != "ES" {
+			break
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("key of type %T cannot verify %s signatures", key, t.header.Alg)
+}
+
+// stringClaim returns the value of a claim if it's a string.
+func (t *jwtToken) stringClaim(name string) string {
+	s, _ := t.claims[name].(string)
+	return s
+}
+
+// timeClaim returns the value of a NumericDate claim, such as exp.
+func (t *jwtToken) timeClaim(name string) (time.Time, bool) {
+	n, ok := t.claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// audience returns the aud claim, which can be either a string or an array
+// of strings.
+func (t *jwtToken) audience() []string {
+	switch v := t.claims["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		aud := []string{}
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+		return aud
+	}
+	return nil
+}
+
+// attributes returns the claims with string values, or arrays of strings, in
+// the same form as released CAS attributes.
+func (t *jwtToken) attributes() map[string][]string {
+	attrs := map[string][]string{}
+	for name, value := range t.claims {
+		switch v := value.(type) {
+		case string:
+			attrs[name] = []string{v}
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					attrs[name] = append(attrs[name], s)
+				}
+			}
+		}
+	}
+	return attrs
+}
+
+// checkClaims validates the registered claims in the token: the issuer, the
+// audience, and the validity period, allowing for clock skew.
+func (t *jwtToken) checkClaims(issuer, audience string, now time.Time, skew time.Duration) error {
+	if issuer != "" && t.stringClaim("iss") != issuer {
+		return fmt.Errorf("token issuer %s is not %s", t.stringClaim("iss"), issuer)
+	}
+
+	if audience != "" {
+		found := false
+		for _, a := range t.audience() {
+			if a == audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token is not intended for %s", audience)
+		}
+	}
+
+	exp, ok := t.timeClaim("exp")
+	if !ok {
+		return errors.New("token does not have an expiration time")
+	}
+	if !now.Add(-skew).Before(exp) {
+		return errors.New("token has expired")
+	}
+
+	if nbf, ok := t.timeClaim("nbf"); ok && now.Add(skew).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+// jwk is a single key from a JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the RSA or elliptic curve public key described by the
+// JWK.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid RSA modulus")
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EC x coordinate")
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EC y coordinate")
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// parseJWKS returns the signing keys in a JSON Web Key Set, keyed by key ID.
+// Keys that can't be used aren't included.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.Wrap(err, "failed to parse key set")
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skipping key %s: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+// keySource provides the public keys that tokens are verified with.
+type keySource interface {
+	// Keys returns the keys that might have signed a token with the key ID.
+	Keys(kid string) ([]crypto.PublicKey, error)
+}
+
+// jwksFetch is a fetch of a key set in progress, which concurrent callers
+// wait for instead of making their own.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// jwksKeys loads and caches the keys in a JSON Web Key Set from a URL or a
+// file. The set is loaded again when a token refers to a key ID that isn't
+// cached, which is how key rotation shows up, but no more often than
+// jwksRefreshInterval.
+type jwksKeys struct {
+	location string
+	client   *http.Client
+
+	mutex    sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time  // When the last fetch started.
+	inFlight *jwksFetch // Nil unless a fetch is in progress.
+}
+
+func newJWKSKeys(location string, client *http.Client) *jwksKeys {
+	return &jwksKeys{
+		location: location,
+		client:   client,
+	}
+}
+
+// read returns the contents of the key set, from the server if the location
+// is a URL and from the file system otherwise.
+func (j *jwksKeys) read() ([]byte, error) {
+	if !strings.HasPrefix(j.location, "http://") && !strings.HasPrefix(j.location, "https://") {
+		b, err := ioutil.ReadFile(j.location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read key set from %s", j.location)
+		}
+		return b, nil
+	}
+
+	resp, err := j.client.Get(j.location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch key set from %s", j.location)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching key set from %s returned status code %d", j.location, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read key set from %s", j.location)
+	}
+	return b, nil
+}
+
+func (j *jwksKeys) fetch() (map[string]crypto.PublicKey, error) {
+	b, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(b)
+}
+
+// refresh fetches the key set again, unless it was fetched within the refresh
+// interval. The mutex isn't held during the fetch, so tokens signed with
+// cached keys can still be verified while it's in progress.
+func (j *jwksKeys) refresh() error {
+	j.mutex.Lock()
+	if call := j.inFlight; call != nil {
+		j.mutex.Unlock()
+		<-call.done
+		return call.err
+	}
+	if time.Since(j.fetched) <= jwksRefreshInterval {
+		j.mutex.Unlock()
+		return nil
+	}
+
+	call := &jwksFetch{
+		done: make(chan struct{}),
+	}
+	j.inFlight = call
+	j.fetched = time.Now()
+	j.mutex.Unlock()
+
+	keys, err := j.fetch()
+
+	j.mutex.Lock()
+	if err == nil {
+		j.keys = keys
+	}
+	call.err = err
+	j.inFlight = nil
+	j.mutex.Unlock()
+	close(call.done)
+
+	return err
+}
+
+// Keys returns the keys that might have signed a token with the key ID. All of
+// the keys are returned if the key ID is empty.
+func (j *jwksKeys) Keys(kid string) ([]crypto.PublicKey, error) {
+	j.mutex.Lock()
+	_, known := j.keys[kid]
+	missing := j.keys == nil || (kid != "" && !known)
+	j.mutex.Unlock()
+
+	if missing {
+		if err := j.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if kid != "" {
+		key, ok := j.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %s", kid)
+		}
+		return []crypto.PublicKey{key}, nil
+	}
+
+	keys := []crypto.PublicKey{}
+	for _, key := range j.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// verifyWithKeys checks the token's signature against each of the candidate
+// keys, succeeding if any of them verifies it.
+func (t *jwtToken) verifyWithKeys(keys []crypto.PublicKey) error {
+	if len(keys) == 0 {
+		return errors.New("no keys are available to verify the token")
+	}
+
+	var err error
+	for _, key := range keys {
+		if err = t.verify(key); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(err, "token signature is invalid")
+}
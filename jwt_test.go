@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The keys that test tokens are signed with. Generating RSA keys is slow, so
+// they're shared by the tests.
+var (
+	testRSAKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	testOtherKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// signTestJWT returns a compact-serialized JWT with the claims, signed with
+// the key using the algorithm.
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	hb, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(pb)
+
+	hash := jwtAlgorithms[alg]
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		if err == nil {
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[size-len(rb):size], rb)
+			copy(sig[2*size-len(sb):], sb)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testJWK returns the JWK for the public key.
+func testJWK(kid string, key crypto.PublicKey) map[string]string {
+	enc := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": enc(k.N.Bytes()), "e": enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": enc(k.X.Bytes()), "y": enc(k.Y.Bytes())}
+	}
+	return nil
+}
+
+// testJWKS returns a JSON Web Key Set with the keys.
+func testJWKS(t *testing.T, keys ...map[string]string) []byte {
+	t.Helper()
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVerify(t *testing.T) {
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		name  string
+		token string
+		key   crypto.PublicKey
+		err   string
+	}{
+		{"RS256", signTestJWT(t, "RS256", "", testRSAKey, claims), &testRSAKey.PublicKey, ""},
+		{"RS512", signTestJWT(t, "RS512", "", testRSAKey, claims), &testRSAKey.PublicKey, ""},
+		{"PS256", signTestJWT(t, "PS256", "", testRSAKey, claims), &testRSAKey.PublicKey, ""},
+		{"ES256", signTestJWT(t, "ES256", "", testECKey, claims), &testECKey.PublicKey, ""},
+		{"wrong key", signTestJWT(t, "RS256", "", testRSAKey, claims), &testOtherKey.PublicKey, "verification error"},
+		{"wrong key type", signTestJWT(t, "ES256", "", testECKey, claims), &testRSAKey.PublicKey, "cannot verify ES256 signatures"},
+		{"algorithm for another key type", signTestJWT(t, "RS256", "", testRSAKey, claims), &testECKey.PublicKey, "cannot verify RS256 signatures"},
+		{"none", signTestJWT(t, "none", "", testRSAKey, claims), &testRSAKey.PublicKey, "unsupported signing algorithm none"},
+		{"HMAC", signTestJWT(t, "HS256", "", testRSAKey, claims), &testRSAKey.PublicKey, "unsupported signing algorithm HS256"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := parseJWT(test.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = token.verify(test.key)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("expected the signature to verify, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	raw := signTestJWT(t, "RS256", "", testRSAKey, map[string]interface{}{"sub": "alice"})
+	parts := strings.Split(raw, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`))
+
+	token, err := parseJWT(strings.Join(parts, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = token.verifyWithKeys([]crypto.PublicKey{&testRSAKey.PublicKey}); err == nil {
+		t.Error("expected a tampered token not to verify")
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{"two parts", "a.b", "three parts"},
+		{"bad header encoding", "!.e30.", "failed to decode token header"},
+		{"bad header", base64.RawURLEncoding.EncodeToString([]byte("[")) + ".e30.", "failed to parse token header"},
+		{"bad payload", "e30." + base64.RawURLEncoding.EncodeToString([]byte("[")) + ".", "failed to parse token payload"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseJWT(test.raw)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCheckClaims(t *testing.T) {
+	now := time.Now()
+	base := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": "https://issuer.example.org",
+			"aud": []string{"other", "app"},
+			"exp": now.Add(time.Minute).Unix(),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+		err    string
+	}{
+		{"valid", func(map[string]interface{}) {}, ""},
+		{"string audience", func(c map[string]interface{}) { c["aud"] = "app" }, ""},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.org" }, "token issuer"},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other" }, "not intended for app"},
+		{"no expiration", func(c map[string]interface{}) { delete(c, "exp") }, "does not have an expiration time"},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }, "token has expired"},
+		{"expired within the skew", func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() }, ""},
+		{"not valid yet", func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }, "not valid yet"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := base()
+			test.change(claims)
+			token, err := parseJWT(signTestJWT(t, "RS256", "", testRSAKey, claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = token.checkClaims("https://issuer.example.org", "app", now, 30*time.Second)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("expected the claims to be valid, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	enc := testJWK("enc", &testOtherKey.PublicKey)
+	enc["use"] = "enc"
+	bad := map[string]string{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQ", "y": "AQ"}
+
+	keys, err := parseJWKS(testJWKS(t, testJWK("rsa", &testRSAKey.PublicKey), testJWK("ec", &testECKey.PublicKey), enc, bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if k, ok := keys["rsa"].(*rsa.PublicKey); !ok || k.N.Cmp(testRSAKey.N) != 0 || k.E != testRSAKey.E {
+		t.Errorf("expected the RSA key to round-trip, got %#v", keys["rsa"])
+	}
+	if k, ok := keys["ec"].(*ecdsa.PublicKey); !ok || k.X.Cmp(testECKey.X) != 0 || k.Y.Cmp(testECKey.Y) != 0 {
+		t.Errorf("expected the EC key to round-trip, got %#v", keys["ec"])
+	}
+}
+
+func TestJWKSKeys(t *testing.T) {
+	var fetches int32
+	jwks := testJWKS(t, testJWK("k1", &testRSAKey.PublicKey))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	j := newJWKSKeys(srv.URL, srv.Client())
+	keys, err := j.Keys("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+
+	// Unknown key IDs only cause a fetch once per refresh interval.
+	if _, err = j.Keys("k2"); err == nil {
+		t.Error("expected an unknown key ID to be an error")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected 1 fetch, got %d", n)
+	}
+
+	// A rotated key is picked up once the interval has passed.
+	jwks = testJWKS(t, testJWK("k1", &testRSAKey.PublicKey), testJWK("k2", &testOtherKey.PublicKey))
+	j.fetched = time.Now().Add(-2 * jwksRefreshInterval)
+	if _, err = j.Keys("k2"); err != nil {
+		t.Errorf("expected the rotated key to be found, got %s", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("expected 2 fetches, got %d", n)
+	}
+}
+
+func TestJWKSKeysConcurrentFetch(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	jwks := testJWKS(t, testJWK("k1", &testRSAKey.PublicKey))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	j := newJWKSKeys(srv.URL, srv.Client())
+	if _, err := j.Keys("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens with an unknown key ID wait for the same fetch, which blocks
+	// until it's released.
+	j.mutex.Lock()
+	j.fetched = time.Now().Add(-2 * jwksRefreshInterval)
+	j.mutex.Unlock()
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.Keys("k2")
+		}()
+	}
+	for atomic.LoadInt32(&fetches) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Tokens signed with a cached key don't wait for the fetch.
+	done := make(chan error)
+	go func() {
+		_, err := j.Keys("k1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the cached key, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a cached key to be returned during the fetch")
+	}
+
+	release <- struct{}{}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("expected concurrent lookups to share 1 fetch, got %d fetches in all", n)
+	}
+}
+
+func TestJWKSKeysFetchErrors(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	j := newJWKSKeys(srv.URL, srv.Client())
+	if _, err := j.Keys("k1"); err == nil || !strings.Contains(err.Error(), "status code 503") {
+		t.Errorf("expected the fetch error, got %v", err)
+	}
+
+	// Failed fetches aren't retried until the interval has passed either.
+	if _, err := j.Keys("k1"); err == nil {
+		t.Error("expected an error without any keys")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected 1 fetch, got %d", n)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// The environment variables that session keys are read from when the key
+// file flags aren't set. The values are base64 encoded.
+const (
+	hashKeyEnv  = "CAS_PROXY_HASH_KEY"
+	blockKeyEnv = "CAS_PROXY_BLOCK_KEY"
+)
+
+// minHashKeySize is the shortest hash key, in bytes, that the proxy will sign
+// session cookies with. It's the output size of the HMAC-SHA256 that signs
+// them.
+const minHashKeySize = 32
+
+// The sizes of the keys generated by gen-key. Block keys select AES-256.
+const (
+	genHashKeySize  = 64
+	genBlockKeySize = 32
+)
+
+// decodeKey decodes a base64-encoded key, accepting both the standard and URL
+// alphabets, with or without padding.
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// loadKey reads a base64-encoded key from the file, or from the environment
+// variable if the file path is empty. It returns nil if neither is set.
+func loadKey(file, env string) ([]byte, error) {
+	var encoded, source string
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read key file %s", file)
+		}
+		encoded, source = string(b), file
+	} else if v, ok := os.LookupEnv(env); ok {
+		encoded, source = v, "$"+env
+	} else {
+		return nil, nil
+	}
+
+	key, err := decodeKey(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the key in %s as base64", source)
+	}
+	return key, nil
+}
+
+// checkHashKey returns an error if the key is too short to sign cookies with.
+func checkHashKey(key []byte) error {
+	if len(key) < minHashKeySize {
+		return fmt.Errorf("hash key is %d bytes long, but must be at least %d", len(key), minHashKeySize)
+	}
+	return nil
+}
+
+// checkBlockKey returns an error if the key isn't a valid AES key size.
+func checkBlockKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("block key is %d bytes long, but must be 16, 24, or 32", len(key))
+}
+
+// loadKeyPairs returns the key pairs that session cookies are signed and
+// encrypted with, newest first. They're read from the keys file if it's set,
+// and otherwise from the hash and block key files or the environment, which
+// only provide one pair. It returns nil if no keys are configured.
+func loadKeyPairs(keysFile, hashKeyFile, blockKeyFile string) ([]keyPair, error) {
+	if keysFile != "" {
+		if hashKeyFile != "" || blockKeyFile != "" {
+			return nil, errors.New("--session-keys-file can't be used with --hash-key-file or --block-key-file")
+		}
+		return readKeysFile(keysFile)
+	}
+
+	hashKey, err := loadKey(hashKeyFile, hashKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	blockKey, err := loadKey(blockKeyFile, blockKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	if hashKey == nil {
+		if blockKey != nil {
+			return nil, errors.New("a block key can't be used without a hash key")
+		}
+		return nil, nil
+	}
+
+	pair := keyPair{hash: hashKey, block: blockKey}
+	if err = checkKeyPair(pair); err != nil {
+		return nil, err
+	}
+	return []keyPair{pair}, nil
+}
+
+// readKeysFile reads the key pairs in the file, which has one pair per line,
+// newest first. Each line has a base64-encoded hash key, optionally followed
+// by whitespace and a base64-encoded block key. Blank lines and lines that
+// start with # are skipped.
+func readKeysFile(keysFile string) ([]keyPair, error) {
+	b, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read keys file %s", keysFile)
+	}
+
+	pairs := []keyPair{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d of %s has more than two keys", i+1, keysFile)
+		}
+
+		var pair keyPair
+		if pair.hash, err = decodeKey(fields[0]); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode the hash key on line %d of %s", i+1, keysFile)
+		}
+		if len(fields) == 2 {
+			if pair.block, err = decodeKey(fields[1]); err != nil {
+				return nil, errors.Wrapf(err, "failed to decode the block key on line %d of %s", i+1, keysFile)
+			}
+		}
+
+		if err = checkKeyPair(pair); err != nil {
+			return nil, errors.Wrapf(err, "invalid keys on line %d of %s", i+1, keysFile)
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", keysFile)
+	}
+	return pairs, nil
+}
+
+// checkKeyPair returns an error if either key in the pair is unusable.
+func checkKeyPair(pair keyPair) error {
+	if err := checkHashKey(pair.hash); err != nil {
+		return err
+	}
+	if pair.block != nil {
+		return checkBlockKey(pair.block)
+	}
+	return nil
+}
+
+// randomKeyPair returns a random hash key, for when no keys are configured.
+// Sessions signed with it don't survive restarts and aren't shared between
+// replicas.
+func randomKeyPair() (keyPair, error) {
+	hashKey := make([]byte, genHashKeySize)
+	if _, err := rand.Read(hashKey); err != nil {
+		return keyPair{}, err
+	}
+	return keyPair{hash: hashKey}, nil
+}
+
+// genKey implements the gen-key subcommand, which prints a random key of the
+// right size for the type of key requested.
+func genKey(args []string) error {
+	fs := flag.NewFlagSet("gen-key", flag.ContinueOnError)
+	keyType := fs.String("type", "hash", "The type of key to generate. One of: hash, block.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var size int
+	switch *keyType {
+	case "hash":
+		size = genHashKeySize
+	case "block":
+		size = genBlockKeySize
+	default:
+		return fmt.Errorf("-type must be one of: hash, block, not %s", *keyType)
+	}
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+// reloadKeysOnHangup reloads the session keys into the store whenever the
+// process receives a SIGHUP. The old keys are kept if the new ones can't be
+// loaded.
+func reloadKeysOnHangup(store *rotatingStore, keysFile, hashKeyFile, blockKeyFile string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		pairs, err := loadKeyPairs(keysFile, hashKeyFile, blockKeyFile)
+		if err == nil && pairs == nil {
+			err = errors.New("no keys are configured")
+		}
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed to reload session keys, so the old ones are still in use"))
+			continue
+		}
+		store.SetKeys(pairs)
+		log.Infof("reloaded %d session key pairs", len(pairs))
+	}
+}
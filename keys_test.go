@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadKeysFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minHashKeySize))
+	urlHash := base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{0xfb}, minHashKeySize))
+	block := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	odd := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 20))
+	short := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minHashKeySize-1))
+
+	tests := []struct {
+		name  string
+		keys  string
+		pairs int
+		err   string
+	}{
+		{"one pair", hash + " " + block + "\n", 1, ""},
+		{"newest first", "# Rotated today.\n" + urlHash + "\n\n" + hash + "\t" + block + "\n", 2, ""},
+		{"empty", "# No keys yet.\n", 0, "no keys found"},
+		{"too many keys", hash + " " + block + " " + block, 0, "line 1 of"},
+		{"not base64", hash + "\n!!!", 0, "failed to decode the hash key on line 2"},
+		{"short hash key", short, 0, "hash key is 31 bytes long"},
+		{"bad block key size", hash + " " + odd, 0, "block key is 20 bytes long"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "keys")
+			if err := ioutil.WriteFile(file, []byte(test.keys), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			pairs, err := readKeysFile(file)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pairs) != test.pairs {
+				t.Fatalf("expected %d pairs, got %d", test.pairs, len(pairs))
+			}
+			if last := pairs[len(pairs)-1]; last.block == nil {
+				t.Error("expected the oldest pair to have its block key")
+			}
+		})
+	}
+}
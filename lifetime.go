@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// maxAccessSaveInterval is the longest that the proxy waits before saving a
+// session's last access time again. Saving it on every request would send a
+// Set-Cookie header with every response.
+const maxAccessSaveInterval = time.Minute
+
+// checkLifetime returns an error if the session has been idle for longer than
+// the idle timeout, has outlived the maximum lifetime, or was created for an
+// identity that has expired. Sessions that don't have the timestamps were
+// created by older versions of the proxy, and are treated as expired when the
+// corresponding limit is enabled.
+func (c *CASProxy) checkLifetime(s *sessions.Session, now time.Time) error {
+	if err := c.checkMaxLifetime(s.Values, now); err != nil {
+		return err
+	}
+
+	if c.idleTimeout > 0 {
+		login, hasLogin := s.Values[sessionLogin].(int64)
+		access, ok := s.Values[sessionAccess].(int64)
+		if !ok {
+			access, ok = login, hasLogin
+		}
+		if !ok {
+			return fmt.Errorf("session does not have a last access time")
+		}
+		if now.Sub(time.Unix(access, 0)) > c.idleTimeout {
+			return fmt.Errorf("session has been idle for longer than %s", c.idleTimeout)
+		}
+	}
+
+	return nil
+}
+
+// checkMaxLifetime returns an error if the session with the values has
+// outlived the maximum lifetime, or the identity it was created for has
+// expired.
+func (c *CASProxy) checkMaxLifetime(values map[interface{}]interface{}, now time.Time) error {
+	if expires, ok := values[sessionExpires].(int64); ok && now.After(time.Unix(expires, 0)) {
+		return fmt.Errorf("session's identity expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	if c.maxLifetime <= 0 {
+		return nil
+	}
+
+	login, ok := values[sessionLogin].(int64)
+	if !ok {
+		return fmt.Errorf("session does not have a login time")
+	}
+	if now.Sub(time.Unix(login, 0)) > c.maxLifetime {
+		return fmt.Errorf("session has outlived the maximum lifetime of %s", c.maxLifetime)
+	}
+	return nil
+}
+
+// accessSaveInterval returns how long to wait before saving the session's
+// last access time again. It's short enough compared to the idle timeout that
+// an active session can't expire because its last access wasn't saved.
+func (c *CASProxy) accessSaveInterval() time.Duration {
+	interval := c.idleTimeout / 10
+	if interval <= 0 || interval > maxAccessSaveInterval {
+		interval = maxAccessSaveInterval
+	}
+	return interval
+}
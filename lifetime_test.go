@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// stubAuthenticator logs everyone in as the identity.
+type stubAuthenticator struct {
+	id *Identity
+}
+
+func (a *stubAuthenticator) Routes(r *mux.Router, p *CASProxy)        {}
+func (a *stubAuthenticator) IsCallback(r *http.Request) bool          { return true }
+func (a *stubAuthenticator) LogoutURL(service string) (string, error) { return service, nil }
+
+func (a *stubAuthenticator) Callback(w http.ResponseWriter, r *http.Request, opts LoginOptions) (*Identity, string, error) {
+	return a.id, "/", nil
+}
+
+func (a *stubAuthenticator) LoginRedirect(w http.ResponseWriter, r *http.Request, opts LoginOptions) {
+	http.Redirect(w, r, "https://idp.example.org/login", http.StatusFound)
+}
+
+func TestCheckLifetime(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		maxLifetime time.Duration
+		values      map[interface{}]interface{}
+		err         string // Empty if the session hasn't expired.
+	}{
+		{"no limits", 0, 0, map[interface{}]interface{}{}, ""},
+		{"active", time.Hour, 8 * time.Hour, map[interface{}]interface{}{sessionLogin: ago(7 * time.Hour), sessionAccess: ago(time.Minute)}, ""},
+		{"idle", time.Hour, 8 * time.Hour, map[interface{}]interface{}{sessionLogin: ago(2 * time.Hour), sessionAccess: ago(61 * time.Minute)}, "idle for longer than 1h0m0s"},
+		{"idle without a maximum lifetime", time.Hour, 0, map[interface{}]interface{}{sessionLogin: ago(time.Minute), sessionAccess: ago(2 * time.Hour)}, "idle"},
+		{"active but too old", time.Hour, 8 * time.Hour, map[interface{}]interface{}{sessionLogin: ago(9 * time.Hour), sessionAccess: ago(time.Minute)}, "outlived the maximum lifetime of 8h0m0s"},
+		{"too old without an idle timeout", 0, 8 * time.Hour, map[interface{}]interface{}{sessionLogin: ago(9 * time.Hour)}, "outlived"},
+		{"old but no maximum lifetime", time.Hour, 0, map[interface{}]interface{}{sessionLogin: ago(90 * 24 * time.Hour), sessionAccess: ago(time.Minute)}, ""},
+		{"idle measured from the login", time.Hour, 0, map[interface{}]interface{}{sessionLogin: ago(2 * time.Hour)}, "idle"},
+		{"no timestamps with an idle timeout", time.Hour, 0, map[interface{}]interface{}{}, "does not have a last access time"},
+		{"no timestamps with a maximum lifetime", 0, 8 * time.Hour, map[interface{}]interface{}{}, "does not have a login time"},
+		{"identity expired", time.Hour, 8 * time.Hour, map[interface{}]interface{}{sessionLogin: ago(time.Hour / 2), sessionAccess: ago(time.Minute), sessionExpires: ago(time.Second)}, "identity expired"},
+		{"identity expired without limits", 0, 0, map[interface{}]interface{}{sessionExpires: ago(time.Second)}, "identity expired"},
+		{"identity still valid", time.Hour, 8 * time.Hour, map[interface{}]interface{}{sessionLogin: ago(time.Hour / 2), sessionAccess: ago(time.Minute), sessionExpires: ago(-time.Minute)}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &CASProxy{idleTimeout: test.idleTimeout, maxLifetime: test.maxLifetime}
+			s := sessions.NewSession(nil, "proxy-session")
+			s.Values = test.values
+
+			err := c.checkLifetime(s, now)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("expected the session to be active, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCallbackKeepsIdentityExpiry(t *testing.T) {
+	pair, err := randomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	c := &CASProxy{
+		auth:         &stubAuthenticator{id: &Identity{Username: "alice", Expires: expires}},
+		sessionName:  "proxy-session",
+		sessionStore: newRotatingStore([]keyPair{pair}, &sessions.Options{Path: "/", MaxAge: 86400}, cookieAttributes{}, false),
+		tickets:      newTicketIndex(0),
+		maxLifetime:  24 * time.Hour,
+	}
+
+	w := httptest.NewRecorder()
+	c.Callback(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected the login to succeed, got %d: %s", w.Code, w.Body)
+	}
+
+	session, err := c.activeSession(requestWithCookies(w))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session ends when the identity does, well before the maximum
+	// lifetime.
+	if err = c.checkLifetime(session, expires.Add(-time.Minute)); err != nil {
+		t.Errorf("expected the session to be active before the identity expired, got %s", err)
+	}
+	if err = c.checkLifetime(session, expires.Add(time.Minute)); err == nil {
+		t.Error("expected the session to end when the identity expired")
+	}
+}
+
+func TestAccessSaveInterval(t *testing.T) {
+	tests := []struct {
+		idleTimeout time.Duration
+		want        time.Duration
+	}{
+		{0, maxAccessSaveInterval},
+		{5 * time.Minute, 30 * time.Second},
+		{time.Hour, maxAccessSaveInterval},
+	}
+
+	for _, test := range tests {
+		if got := (&CASProxy{idleTimeout: test.idleTimeout}).accessSaveInterval(); got != test.want {
+			t.Errorf("idle timeout %s: expected %s, got %s", test.idleTimeout, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// loginStateParam is the query parameter that carries the login state's nonce
+// through the round-trip to CAS, as part of the service URL.
+const loginStateParam = "cas-proxy-login"
+
+// loginRetryParam is added to the URL that a restarted login returns to, so
+// that a login that can't be finished the second time either isn't restarted
+// forever.
+const loginRetryParam = "cas-proxy-retry"
+
+// loginStateTimeout is how long a user has to log in with the provider before
+// the login state expires.
+const loginStateTimeout = 10 * time.Minute
+
+// errLoginStateMissing is returned when the browser doesn't have the cookie for
+// a login state, such as when a link with someone else's ticket is followed.
+var errLoginStateMissing = errors.New("the login state cookie is missing")
+
+// loginState is stored in a signed and encrypted cookie before the user is
+// sent to CAS. A ticket is only accepted if it comes back to the same service
+// in a browser that has the cookie, so an attacker can't log a victim in to
+// the attacker's account with a link that has the attacker's ticket in it.
+type loginState struct {
+	Nonce   string
+	Service string
+	Started int64
+}
+
+// loginStateStore sets and checks the cookies that hold the state of logins
+// in progress. Each login gets its own cookie, named after its key, so that
+// logins in different tabs don't replace each other's. Each state can only be
+// used once.
+type loginStateStore struct {
+	cookies *rotatingStore // Encodes the cookies with the session keys.
+	name    string         // The prefix of the cookie names.
+	mutex   sync.Mutex
+	used    map[string]time.Time // When the used keys expire.
+}
+
+func newLoginStateStore(cookies *rotatingStore, name string) *loginStateStore {
+	return &loginStateStore{
+		cookies: cookies,
+		name:    name,
+		used:    map[string]time.Time{},
+	}
+}
+
+// cookieName returns the name of the cookie for the login with the key.
+func (s *loginStateStore) cookieName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return s.name + "-" + hex.EncodeToString(sum[:8])
+}
+
+// options returns the cookie options, which are the session cookie's with the
+// max age.
+func (s *loginStateStore) options(maxAge int) *sessions.Options {
+	opts := *s.cookies.Options
+	opts.MaxAge = maxAge
+	return &opts
+}
+
+// save sets the cookie for the login with the key to the state. It has to be
+// sent with the redirect back from the provider, so it's never SameSite=Strict.
+func (s *loginStateStore) save(w http.ResponseWriter, r *http.Request, key string, state interface{}) error {
+	name := s.cookieName(key)
+	encoded, err := securecookie.EncodeMulti(name, state, s.cookies.encodingCodecs()...)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the login state")
+	}
+
+	opts := s.options(int(loginStateTimeout / time.Second))
+	http.SetCookie(w, s.cookies.attrs.forRedirects().newCookie(r, name, encoded, opts))
+	return nil
+}
+
+// load decodes the state of the login with the key into state, and deletes its
+// cookie. The cookies of other logins are left alone.
+func (s *loginStateStore) load(w http.ResponseWriter, r *http.Request, key string, state interface{}) error {
+	name := s.cookieName(key)
+	c, err := r.Cookie(name)
+	if err != nil {
+		return errLoginStateMissing
+	}
+	http.SetCookie(w, s.cookies.attrs.forRedirects().newCookie(r, name, "", s.options(-1)))
+
+	if _, err = s.cookies.decode(name, c.Value, state); err != nil {
+		return errors.Wrap(err, "failed to decode the login state")
+	}
+	return nil
+}
+
+// Start returns a new nonce for the login and sets the cookie that binds it
+// to the service URL. The nonce has to be added to the service URL before it's
+// passed to CAS, so it has to be called with the URL as it would be without
+// the nonce.
+func (s *loginStateStore) Start(w http.ResponseWriter, r *http.Request, service string) (string, error) {
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	state := &loginState{
+		Nonce:   nonce,
+		Service: service,
+		Started: time.Now().Unix(),
+	}
+	if err = s.save(w, r, nonce, state); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// Finish checks that the browser has the cookie for the nonce and that it was
+// set for the service URL, which is the one without the nonce. The state is
+// used up either way.
+func (s *loginStateStore) Finish(w http.ResponseWriter, r *http.Request, nonce, service string) error {
+	if nonce == "" {
+		return errLoginStateMissing
+	}
+
+	state := &loginState{}
+	if err := s.load(w, r, nonce, state); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(state.Nonce)) != 1 {
+		return errors.New("the login state doesn't match")
+	}
+	if state.Service != service {
+		return fmt.Errorf("the login state is for %s, not %s", state.Service, service)
+	}
+
+	started := time.Unix(state.Started, 0)
+	if time.Since(started) > loginStateTimeout {
+		return errors.New("the login took too long")
+	}
+
+	if !s.use(state.Nonce, started.Add(loginStateTimeout)) {
+		return errors.New("the login state was already used")
+	}
+	return nil
+}
+
+// use marks the key as used. It returns false if it already was.
+func (s *loginStateStore) use(key string, expires time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for k, v := range s.used {
+		if now.After(v) {
+			delete(s.used, k)
+		}
+	}
+
+	if _, ok := s.used[key]; ok {
+		return false
+	}
+	s.used[key] = expires
+	return true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const testService = "https://proxy.example.org/app?x=1"
+
+// newTestLoginStates returns a login state store whose cookies have the
+// session cookie's attributes, which are SameSite=Strict.
+func newTestLoginStates(t *testing.T) *loginStateStore {
+	pair, err := randomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+	attrs := cookieAttributes{secure: cookieSecureAlways, sameSite: http.SameSiteStrictMode}
+	return newLoginStateStore(newRotatingStore([]keyPair{pair}, opts, attrs, false), "proxy-session-login")
+}
+
+// startTestLoginState starts a login for the service, and returns its nonce
+// and cookie.
+func startTestLoginState(t *testing.T, s *loginStateStore, service string) (string, *http.Cookie) {
+	w := httptest.NewRecorder()
+	nonce, err := s.Start(w, httptest.NewRequest(http.MethodGet, service, nil), service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %v", cookies)
+	}
+	return nonce, cookies[0]
+}
+
+// finishTestLoginState finishes the login with the cookies, and returns the
+// cookies that were set.
+func finishTestLoginState(s *loginStateStore, nonce, service string, cookies ...*http.Cookie) ([]*http.Cookie, error) {
+	r := httptest.NewRequest(http.MethodGet, service, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	err := s.Finish(w, r, nonce, service)
+	return w.Result().Cookies(), err
+}
+
+func TestLoginState(t *testing.T) {
+	s := newTestLoginStates(t)
+	nonce, cookie := startTestLoginState(t, s, testService)
+
+	// The cookie has to come back with the cross-site redirect from the
+	// provider.
+	if cookie.SameSite != http.SameSiteLaxMode || !cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("expected a secure, HTTP-only, SameSite=Lax cookie, got %s", cookie)
+	}
+	if cookie.MaxAge != int(loginStateTimeout/time.Second) {
+		t.Errorf("expected the cookie to last %s, got %d seconds", loginStateTimeout, cookie.MaxAge)
+	}
+
+	set, err := finishTestLoginState(s, nonce, testService, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 1 || set[0].Name != cookie.Name || set[0].MaxAge >= 0 {
+		t.Errorf("expected the login state cookie to be deleted, got %v", set)
+	}
+
+	// A state can only be used once, even if the cookie is replayed.
+	if _, err = finishTestLoginState(s, nonce, testService, cookie); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected a replayed state to be rejected, got %v", err)
+	}
+}
+
+func TestLoginStateErrors(t *testing.T) {
+	s := newTestLoginStates(t)
+	r := httptest.NewRequest(http.MethodGet, testService, nil)
+
+	// saveState sets a cookie for the nonce with the state.
+	saveState := func(nonce string, state *loginState) *http.Cookie {
+		w := httptest.NewRecorder()
+		if err := s.save(w, r, nonce, state); err != nil {
+			t.Fatal(err)
+		}
+		return w.Result().Cookies()[0]
+	}
+
+	nonce, cookie := startTestLoginState(t, s, testService)
+	other, otherCookie := startTestLoginState(t, s, testService)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		nonce   string
+		service string
+		cookie  *http.Cookie
+		err     string
+	}{
+		{"no nonce", "", testService, cookie, errLoginStateMissing.Error()},
+		{"missing cookie", nonce, testService, nil, errLoginStateMissing.Error()},
+		{"another login's cookie", nonce, testService, otherCookie, errLoginStateMissing.Error()},
+		{"another service", nonce, "https://proxy.example.org/other", cookie, "the login state is for"},
+		{"state for another nonce", other, testService, saveState(other, &loginState{Nonce: nonce, Service: testService, Started: now}), "doesn't match"},
+		{"expired", "expired", testService, saveState("expired", &loginState{Nonce: "expired", Service: testService, Started: now - int64(2*loginStateTimeout/time.Second)}), "took too long"},
+		{"undecodable cookie", nonce, testService, &http.Cookie{Name: cookie.Name, Value: "garbage"}, "failed to decode"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookies := []*http.Cookie{}
+			if test.cookie != nil {
+				cookies = append(cookies, test.cookie)
+			}
+			_, err := finishTestLoginState(s, test.nonce, test.service, cookies...)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestConcurrentLoginStates(t *testing.T) {
+	s := newTestLoginStates(t)
+	first, firstCookie := startTestLoginState(t, s, testService)
+	second, secondCookie := startTestLoginState(t, s, "https://proxy.example.org/other")
+	if first == second || firstCookie.Name == secondCookie.Name {
+		t.Fatalf("expected each login to get its own nonce and cookie, got %s and %s", firstCookie.Name, secondCookie.Name)
+	}
+
+	// Both logins finish, in either order, with both cookies in the browser.
+	// Finishing one only deletes its own cookie.
+	set, err := finishTestLoginState(s, second, "https://proxy.example.org/other", firstCookie, secondCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 1 || set[0].Name != secondCookie.Name {
+		t.Errorf("expected only the second login's cookie to be deleted, got %v", set)
+	}
+	if _, err = finishTestLoginState(s, first, testService, firstCookie); err != nil {
+		t.Errorf("expected the first login to finish, got %s", err)
+	}
+}
+
+func TestCASCallbackRestartsLogin(t *testing.T) {
+	a := &CASAuthenticator{
+		frontendURL: "https://proxy.example.org",
+		loginStates: newTestLoginStates(t),
+	}
+
+	// A ticket without the browser's login state, such as one in a link from
+	// someone else, restarts the login instead of being validated.
+	r := httptest.NewRequest(http.MethodGet, "https://proxy.example.org/app?x=1&"+loginStateParam+"=abc&ticket=ST-1", nil)
+	_, returnURL, err := a.Callback(httptest.NewRecorder(), r, LoginOptions{})
+	if err != ErrRestartLogin {
+		t.Fatalf("expected ErrRestartLogin, got %v", err)
+	}
+	u, err := url.Parse(returnURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/app" || q.Get("x") != "1" || q.Get(loginRetryParam) == "" || q.Get(loginStateParam) != "" {
+		t.Errorf("expected to return to /app?x=1 with the retry parameter, got %s", returnURL)
+	}
+
+	// A restarted login that fails again is an error.
+	r = httptest.NewRequest(http.MethodGet, returnURL+"&"+loginStateParam+"=def&ticket=ST-2", nil)
+	if _, _, err = a.Callback(httptest.NewRecorder(), r, LoginOptions{}); err == nil || err == ErrRestartLogin {
+		t.Errorf("expected a second failure to be an error, got %v", err)
+	}
+}
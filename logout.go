@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultReservedPrefix is the default path prefix for the endpoints that the
+// proxy handles itself instead of forwarding to the backend.
+const defaultReservedPrefix = "/_cas-proxy"
+
+// logoutPath is the path, relative to the reserved prefix, that ends the
+// user's session.
+const logoutPath = "/logout"
+
+// isUnder returns true if the URL has the same scheme and host as the base
+// URL, and its path is the base's path or one beneath it.
+func isUnder(rawURL, base string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User != nil {
+		return false
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != b.Scheme || !strings.EqualFold(u.Host, b.Host) {
+		return false
+	}
+
+	basePath := strings.TrimSuffix(b.Path, "/")
+	p := path.Clean("/" + u.Path)
+	return p == basePath || strings.HasPrefix(p, basePath+"/")
+}
+
+// checkLogoutService returns the service URL that the provider can redirect
+// to after logging the user out. URLs that aren't under the frontend URL are
+// dropped, so that the logout endpoint can't redirect anywhere.
+func checkLogoutService(service, frontendURL string) string {
+	if service != "" && !isUnder(service, frontendURL) {
+		log.Infof("ignoring logout service URL %s, which isn't under the frontend URL", service)
+		return ""
+	}
+	return service
+}
+
+// Logout ends the user's session by deleting the session cookie and revoking
+// the login it was created from, then redirects to the provider's logout page
+// so that the single sign-on session ends too. The optional service query
+// parameter is passed along to the provider as the URL to return to
+// afterwards.
+func (c *CASProxy) Logout(w http.ResponseWriter, r *http.Request) {
+	logoutURL, err := c.auth.LogoutURL(r.URL.Query().Get("service"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// An error means the cookie couldn't be decoded, but a new session is still
+	// returned that can be used to overwrite it.
+	session, err := c.sessionStore.Get(r, c.sessionName)
+	if err != nil {
+		log.Infof("logging out an undecodable session: %s", err)
+	}
+
+	if ticket, ok := session.Values[sessionTicket].(string); ok && ticket != "" {
+		c.revokeTicket(ticket)
+	}
+
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	session.Options.MaxAge = -1
+	if err = session.Save(r, w); err != nil {
+		err = errors.Wrap(err, "error deleting session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, logoutURL, http.StatusFound)
+}
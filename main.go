@@ -2,16 +2,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
@@ -27,36 +30,50 @@ var log = logrus.WithFields(logrus.Fields{
 	"group":   "org.cyverse",
 })
 
+// sessionName is the name of the session cookie, or its prefix when the name
+// is derived from the analysis.
 const sessionName = "proxy-session"
+
 const sessionKey = "proxy-session-key"
 const sessionAccess = "proxy-session-last-access"
+const sessionAttributes = "proxy-session-attributes"
+const sessionPGT = "proxy-session-pgt"
+const sessionTicket = "proxy-session-ticket"
+const sessionRenewed = "proxy-session-renewed"
+const sessionLogin = "proxy-session-login"
+const sessionExpires = "proxy-session-expires"
+const sessionClientIP = "proxy-session-client-ip"
+const sessionUserAgent = "proxy-session-user-agent"
 
 // CASProxy contains the application logic that handles authentication, session
-// validations, ticket validation, and request proxying.
+// validations, and request proxying. Logging users in is delegated to an
+// Authenticator.
 type CASProxy struct {
-	casBase        string // base URL for the CAS server
-	casValidate    string // The path to the validation endpoint on the CAS server.
-	frontendURL    string // The URL placed into service query param for CAS.
-	backendURL     string // The backend URL to forward to.
-	wsbackendURL   string // The websocket URL to forward requests to.
-	resourceType   string // The resource type for analysis.
-	resourceName   string // The UUID of the analysis.
-	ingressURL     string // The URL to the cluster ingress.
-	accessHeader   string // The Host header for checking resource access perms.
-	analysisHeader string // The Host header for getting the analysis ID.
-	sessionStore   *sessions.CookieStore
-}
-
-// NewCASProxy returns a newly instantiated *CASProxy.
-func NewCASProxy(casBase, casValidate, frontendURL, backendURL, wsbackendURL string, cs *sessions.CookieStore) *CASProxy {
-	return &CASProxy{
-		casBase:      casBase,
-		casValidate:  casValidate,
-		frontendURL:  frontendURL,
-		backendURL:   backendURL,
-		wsbackendURL: wsbackendURL,
-		sessionStore: cs,
-	}
+	auth           Authenticator         // Logs users in.
+	bearer         *BearerAuthenticator  // Identifies API clients by their bearer tokens. Nil if they aren't accepted.
+	passwords      PasswordAuthenticator // Checks Basic credentials. Nil if they aren't accepted.
+	basicPaths     pathPatterns          // The paths that accept Basic credentials.
+	basicCache     *basicCache
+	backendURL     string        // The backend URL to forward to.
+	wsbackendURL   string        // The websocket URL to forward requests to.
+	resourceType   string        // The resource type for analysis.
+	resourceName   string        // The UUID of the analysis.
+	reservedPrefix string        // The path prefix for endpoints handled by the proxy itself.
+	gatewayPaths   pathPatterns  // The paths that only use an existing single sign-on session.
+	gatewayMaxAge  time.Duration // How long to skip gateway redirects after the provider finds no session.
+	renewPaths     pathPatterns  // The paths that require a recent primary login.
+	renewMaxAge    time.Duration // How long a renewed login counts as recent.
+	idleTimeout    time.Duration // How long a session lasts without requests. Zero means forever.
+	maxLifetime    time.Duration // How long a session lasts after logging in. Zero means forever.
+	sessionName    string        // The name of the session cookie.
+	sessionAttrs   []string      // The released attributes kept in the session. Empty means all of them.
+	sessionStore   sessions.Store
+	cookies        *rotatingStore // Sets the proxy's other cookies with the session cookie's attributes.
+	tickets        *ticketIndex
+	conns          *connTracker    // The open websocket connections.
+	binding        *sessionBinding // The client characteristics sessions are bound to. Nil if they aren't.
+	trustedProxies ipNets          // The proxies whose X-Forwarded-For headers are trusted.
+	authz          Authorizer      // Decides whether users can make requests.
 }
 
 // Analysis contains the ID for the Analysis, which gets used as the resource
@@ -70,7 +87,7 @@ type Analyses struct {
 	Analyses []Analysis `json:"analyses"`
 }
 
-func (c *CASProxy) getResourceName(externalID string) (string, error) {
+func getResourceName(ingressURL, analysisHeader, externalID string) (string, error) {
 	bodymap := map[string]string{}
 	bodymap["external_id"] = externalID
 
@@ -79,12 +96,12 @@ func (c *CASProxy) getResourceName(externalID string) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.ingressURL, bytes.NewReader(body))
+	req, err := http.NewRequest(http.MethodPost, ingressURL, bytes.NewReader(body))
 	if err != nil {
 		return "", err
 	}
 
-	req.Host = c.analysisHeader
+	req.Host = analysisHeader
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -142,222 +159,212 @@ type PermissionList struct {
 	Permissions []Permission `json:"permissions"`
 }
 
-// IsAllowed will return true if the user is allowed to access the running app
-// and false if they're not. An error might be returned as well. Access should
-// be denied if an error is returned, even if the boolean return value is true.
-func (c *CASProxy) IsAllowed(user, resource string) (bool, error) {
-	bodymap := map[string]string{
-		"subject":  user,
-		"resource": resource,
+// loginOptions returns the options for logging in to access the request's
+// path.
+func (c *CASProxy) loginOptions(r *http.Request) LoginOptions {
+	renew := c.requiresRenew(r)
+	return LoginOptions{
+		ForceReauth: renew,
+		Passive:     !renew && c.gatewayPaths.Match(r.URL.Path),
 	}
+}
 
-	body, err := json.Marshal(bodymap)
-	if err != nil {
-		return false, err
-	}
+// IsCallback implements the mux.Matcher interface so that requests returning
+// from the provider's login page can be routed to the Callback handler.
+func (c *CASProxy) IsCallback(r *http.Request, m *mux.RouteMatch) bool {
+	return c.auth.IsCallback(r)
+}
 
-	request, err := http.NewRequest(http.MethodPost, c.ingressURL, bytes.NewReader(body))
-	if err != nil {
-		return false, err
+// Callback completes a login with the provider and stores the user's identity
+// in the session.
+func (c *CASProxy) Callback(w http.ResponseWriter, r *http.Request) {
+	id, returnURL, err := c.auth.Callback(w, r, c.loginOptions(r))
+	if err == ErrNotLoggedIn || err == ErrRestartLogin {
+		// The gateway cookie set before the redirect lets the request through
+		// anonymously, and a restarted login goes through the login redirect
+		// again.
+		http.Redirect(w, r, returnURL, http.StatusFound)
+		return
 	}
-
-	request.Host = c.accessHeader
-
-	client := &http.Client{}
-	resp, err := client.Do(request)
 	if err != nil {
-		return false, err
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
-	defer resp.Body.Close()
 
-	b, err := ioutil.ReadAll(resp.Body)
+	// Store a session, hopefully to short-circuit the CAS redirect dance in later
+	// requests. The max age of the cookie should be less than the lifetime of
+	// the CAS ticket, which is around 10+ hours. This means that we'll be hitting
+	// the CAS server fairly often. Adjust the max age to rate limit requests to
+	// CAS.
+	var s *sessions.Session
+	s, err = c.sessionStore.Get(r, c.sessionName)
 	if err != nil {
-		return false, err
-	}
-
-	l := &PermissionList{
-		Permissions: []Permission{},
+		err = errors.Wrap(err, "error getting session")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if err = json.Unmarshal(b, l); err != nil {
-		return false, err
+	// Nothing from an earlier login should carry over, including the session
+	// ID, so that an ID planted before the login is worthless afterwards.
+	for k := range s.Values {
+		delete(s.Values, k)
 	}
-
-	if len(l.Permissions) > 0 {
-		if l.Permissions[0].Level != "" {
-			return true, nil
+	if rg, ok := c.sessionStore.(sessionRegenerator); ok {
+		if err = rg.Regenerate(s); err != nil {
+			err = errors.Wrap(err, "error regenerating session")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
-
-	return false, nil
-}
-
-// ValidateTicket will validate a CAS ticket against the configured CAS server.
-func (c *CASProxy) ValidateTicket(w http.ResponseWriter, r *http.Request) {
-	casURL, err := url.Parse(c.casBase)
-	if err != nil {
-		err = errors.Wrapf(err, "failed to parse CAS base URL %s", c.casBase)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	now := time.Now().Unix()
+	s.Values[sessionKey] = id.Username
+	if attrs := c.keptAttributes(id.Attributes); len(attrs) > 0 {
+		s.Values[sessionAttributes] = attrs
+	}
+	s.Values[sessionLogin] = now
+	s.Values[sessionAccess] = now
+	s.Values[sessionClientIP] = c.clientIP(r)
+	s.Values[sessionUserAgent] = r.UserAgent()
+	if fp := certFingerprint(r); fp != "" {
+		s.Values[sessionCertFingerprint] = fp
+	}
+	if id.SessionIndex != "" {
+		s.Values[sessionTicket] = id.SessionIndex
+	}
+	if id.Reauthenticated {
+		s.Values[sessionRenewed] = now
+	}
+	if !id.Expires.IsZero() {
+		s.Values[sessionExpires] = id.Expires.Unix()
+	}
+	for k, v := range id.Extra {
+		s.Values[k] = v
+	}
+	err = s.Save(r, w)
+	if _, ok := s.Values[sessionAttributes]; ok && err == errCookieTooLarge {
+		// Providers can release many groups, so the login isn't failed just
+		// because they don't fit. Rules about the attributes won't match them.
+		log.Warnf("the attributes released for %s don't fit in the session cookie, so they weren't kept. Limit them with --session-attributes or use a server-side --session-backend.", id.Username)
+		delete(s.Values, sessionAttributes)
+		err = s.Save(r, w)
 	}
-
-	// Make sure the path in the CAS params is the same as the one that was
-	// requested.
-	svcURL, err := url.Parse(c.frontendURL)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to parse the frontend URL %s", c.frontendURL)
+		err = errors.Wrap(err, "error saving session")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if id.SessionIndex != "" {
+		c.tickets.Add(id.SessionIndex, id.Username)
+	}
 
-	// Ensure that the service path and the query params are set to the incoming
-	// request's values for those fields.
-	svcURL.Path = r.URL.Path
-	sq := r.URL.Query()
-	sq.Del("ticket") // Remove the ticket from the service URL. Redirection loops occur otherwise.
-	svcURL.RawQuery = sq.Encode()
-
-	// The request URL for CAS ticket validation needs to have the service and
-	// ticket in it.
-	casURL.Path = path.Join(casURL.Path, c.casValidate)
-	q := casURL.Query()
-	q.Add("service", svcURL.String())
-	q.Add("ticket", r.URL.Query().Get("ticket"))
-	casURL.RawQuery = q.Encode()
+	http.Redirect(w, r, returnURL, http.StatusFound)
+}
 
-	// Actually validate the ticket.
-	resp, err := http.Get(casURL.String())
-	if err != nil {
-		err = errors.Wrap(err, "ticket validation error")
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+// keptAttributes returns the released attributes that are kept in the
+// session.
+func (c *CASProxy) keptAttributes(attributes map[string][]string) map[string][]string {
+	if len(c.sessionAttrs) == 0 {
+		return attributes
 	}
-
-	// If this happens then something went wrong on the CAS side of things. Doesn't
-	// mean the ticket is invalid, just that the CAS server is in a state where
-	// we can't trust the response.
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		err = errors.Wrapf(err, "ticket validation status code was %d", resp.StatusCode)
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+	kept := map[string][]string{}
+	for _, name := range c.sessionAttrs {
+		if v, ok := attributes[name]; ok {
+			kept[name] = v
+		}
 	}
+	return kept
+}
 
-	b, err := ioutil.ReadAll(resp.Body)
+// ResetSessionExpiration records the time of the request as the session's
+// last access, which the idle timeout is measured from. To avoid sending a
+// Set-Cookie header with every response, the session is only saved if the
+// last recorded access is older than the save interval, or if its cookie has
+// to be re-issued with a newer key.
+func (c *CASProxy) ResetSessionExpiration(w http.ResponseWriter, r *http.Request) error {
+	session, err := c.sessionStore.Get(r, c.sessionName)
 	if err != nil {
-		err = errors.Wrap(err, "error reading body of CAS response")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer resp.Body.Close()
 
-	// This is where the actual ticket validation happens. If the CAS server
-	// returns 'no\n\n' in the body, then the validation was not successful. The
-	// HTTP status code will be in the 200 range regardless of the validation
-	// status.
-	if bytes.Equal(b, []byte("no\n\n")) {
-		err = fmt.Errorf("ticket validation response body was %s", b)
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+	if _, ok := session.Values[sessionKey].(string); !ok {
+		return errors.New("session value not found")
 	}
 
-	fields := bytes.Fields(b)
-	if len(fields) < 2 {
-		err = errors.New("not enough fields in ticket validation response body")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	now := time.Now()
+	last, _ := session.Values[sessionAccess].(int64)
+	if !needsReissue(session) && now.Sub(time.Unix(last, 0)) < c.accessSaveInterval() {
+		return nil
 	}
 
-	username := string(fields[1])
+	session.Values[sessionAccess] = now.Unix()
+	return session.Save(r, w)
+}
 
-	// Store a session, hopefully to short-circuit the CAS redirect dance in later
-	// requests. The max age of the cookie should be less than the lifetime of
-	// the CAS ticket, which is around 10+ hours. This means that we'll be hitting
-	// the CAS server fairly often. Adjust the max age to rate limit requests to
-	// CAS.
-	var s *sessions.Session
-	s, err = c.sessionStore.Get(r, sessionName)
+// activeSession returns the session for the request if it belongs to a user
+// who is logged in and hasn't been logged out by the provider.
+func (c *CASProxy) activeSession(r *http.Request) (*sessions.Session, error) {
+	session, err := c.sessionStore.Get(r, c.sessionName)
 	if err != nil {
-		err = errors.Wrap(err, "error getting session")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, errors.Wrap(err, "failed to get session")
 	}
-	s.Values[sessionKey] = username
-	s.Save(r, w)
 
-	http.Redirect(w, r, svcURL.String(), http.StatusFound)
-}
+	username, ok := session.Values[sessionKey].(string)
+	if !ok {
+		return nil, errors.New("session value not found")
+	}
+	if username == "" {
+		return nil, errors.New("session value was empty instead of a username")
+	}
 
-// ResetSessionExpiration should reset the session expiration time.
-func (c *CASProxy) ResetSessionExpiration(w http.ResponseWriter, r *http.Request) error {
-	session, err := c.sessionStore.Get(r, sessionName)
-	if err != nil {
-		return err
+	if ticket, ok := session.Values[sessionTicket].(string); ok && c.tickets.IsRevoked(ticket) {
+		return nil, fmt.Errorf("session for %s was logged out", username)
 	}
 
-	msg, ok := session.Values[sessionKey]
-	if !ok {
-		return errors.New("session value not found")
+	if err = c.checkLifetime(session, time.Now()); err != nil {
+		return nil, errors.Wrapf(err, "session for %s expired", username)
 	}
 
-	session.Values[sessionKey] = msg.(string)
-	session.Save(r, w)
-	return nil
+	if err = c.checkBinding(r, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
 }
 
 // Session implements the mux.Matcher interface so that requests can be routed
 // based on cookie existence.
 func (c *CASProxy) Session(r *http.Request, m *mux.RouteMatch) bool {
-	session, err := c.sessionStore.Get(r, sessionName)
-	if err != nil {
-		return true
+	// API clients can't follow a redirect to a login page, so requests with
+	// bearer tokens or Basic credentials go straight to the proxy, which
+	// rejects invalid ones.
+	if c.usesBearer(r) || c.usesBasicAuth(r) {
+		return false
 	}
 
-	msgraw, ok := session.Values[sessionKey]
-	if !ok {
+	session, err := c.activeSession(r)
+	if err != nil {
+		log.Info(err)
 		return true
 	}
-	msg := msgraw.(string)
-	if msg == "" {
-		log.Infof("session value was empty instead of a username")
+
+	if c.requiresRenew(r) && !c.isFresh(session) {
 		return true
 	}
 
 	return false
 }
 
-// RedirectToCAS redirects the request to CAS, setting the service query
-// parameter to the value in frontendURL.
-func (c *CASProxy) RedirectToCAS(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("redirect to cas")
-	casURL, err := url.Parse(c.casBase)
-	if err != nil {
-		err = errors.Wrapf(err, "failed to parse CAS base URL %s", c.casBase)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// Login sends the user to the provider to log in.
+func (c *CASProxy) Login(w http.ResponseWriter, r *http.Request) {
+	opts := c.loginOptions(r)
 
-	// Make sure the path in the CAS params is the same as the one that was
-	// requested.
-	svcURL, err := url.Parse(c.frontendURL)
-	if err != nil {
-		err = errors.Wrapf(err, "failed to parse the frontend URL %s", c.frontendURL)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Remember that the user was sent to log in passively, so that they aren't
+	// sent again when the provider returns without logging them in.
+	if opts.Passive {
+		c.setGatewayCookie(w, r)
 	}
 
-	// Make sure the serivce path and the query params are set to the incoming
-	// requests values for those fields.
-	svcURL.Path = r.URL.Path
-	svcURL.RawQuery = r.URL.RawQuery
-
-	//set the service query param in the casURL.
-	q := casURL.Query()
-	q.Add("service", svcURL.String())
-	casURL.RawQuery = q.Encode()
-	casURL.Path = path.Join(casURL.Path, "login")
-
-	// perform the redirect
-	http.Redirect(w, r, casURL.String(), http.StatusTemporaryRedirect)
+	c.auth.LoginRedirect(w, r, opts)
 }
 
 // ReverseProxy returns a proxy that forwards requests to the configured
@@ -436,8 +443,9 @@ func (c *CASProxy) URLIsReady(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Proxy returns a handler that can support both websockets and http requests.
-func (c *CASProxy) Proxy() (http.Handler, error) {
+// backend returns a handler that forwards both websockets and http requests to
+// the backend without any checks.
+func (c *CASProxy) backend() (http.Handler, error) {
 	ws, err := c.WSReverseProxy()
 	if err != nil {
 		return nil, err
@@ -449,90 +457,278 @@ func (c *CASProxy) Proxy() (http.Handler, error) {
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//Get the username from the cookie
-		session, err := c.sessionStore.Get(r, sessionName)
-		if err != nil {
-			err = errors.Wrap(err, "failed to get session")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if c.isWebsocket(r) {
+			ws.ServeHTTP(w, r)
 			return
 		}
+		rp.ServeHTTP(w, r)
+	}), nil
+}
 
-		username := session.Values[sessionKey].(string)
-		if username == "" {
-			err = errors.Wrap(err, "username was empty")
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
-		}
+// Proxy returns a handler that can support both websockets and http requests.
+func (c *CASProxy) Proxy() (http.Handler, error) {
+	backend, err := c.backend()
+	if err != nil {
+		return nil, err
+	}
 
-		// Check to make sure the user can access the resource.
-		allowed, err := c.IsAllowed(username, c.resourceName)
-		if !allowed || err != nil {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var username, sessionID string
+		var attributes map[string][]string
+		var values map[interface{}]interface{}
+		var expires time.Time
+		fromSession := false
+		switch {
+		case c.usesBearer(r):
+			token, _ := bearerToken(r)
+			id, err := c.bearer.Identify(token)
 			if err != nil {
-				err = errors.Wrap(err, "access denied")
-			} else {
-				err = errors.New("access denied")
+				err = errors.Wrap(err, "invalid bearer token")
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			username, attributes, expires = id.Username, id.Attributes, id.Expires
+
+			// The token could be replayed against other services that accept
+			// it, so the backend doesn't get to see it.
+			r.Header.Del("Authorization")
+
+		case c.usesBasicAuth(r):
+			id, err := c.basicLogin(r)
+			if err != nil {
+				err = errors.Wrap(err, "invalid credentials")
+				w.Header().Set("WWW-Authenticate", basicRealm)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			username, attributes = id.Username, id.Attributes
+			r.Header.Del("Authorization")
+
+		default:
+			//Get the username from the cookie
+			session, err := c.sessionStore.Get(r, c.sessionName)
+			if err != nil {
+				err = errors.Wrap(err, "failed to get session")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+
+			username, _ = session.Values[sessionKey].(string)
+			if username == "" {
+				http.Error(w, "username was empty", http.StatusForbidden)
+				return
+			}
+			attributes, _ = session.Values[sessionAttributes].(map[string][]string)
+			sessionID = session.ID
+			values = session.Values
+			fromSession = true
+		}
+
+		// Check to make sure the user can make the request.
+		req := &AccessRequest{
+			Username:   username,
+			Attributes: attributes,
+			Resource:   c.resourceName,
+			Method:     c.requestMethod(r),
+			Path:       r.URL.Path,
+		}
+		decision, err := c.authz.Authorize(req)
+		if err != nil {
+			err = errors.Wrap(err, "access denied")
 			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
+		if !decision.Allowed {
+			http.Error(w, "access denied: "+decision.Reason, http.StatusForbidden)
+			return
+		}
 
 		log.Printf("%+v\n", r.Header)
 
-		if err = c.ResetSessionExpiration(w, r); err != nil {
-			err = errors.Wrap(err, "error resetting session expiration")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		// Requests with bearer tokens or Basic credentials don't have a
+		// session to reset.
+		if fromSession {
+			err = c.ResetSessionExpiration(w, r)
+			if err == errSessionRevoked {
+				// The session was revoked after it was loaded, and its cookie
+				// has been deleted, so the next request logs in again.
+				http.Error(w, "access denied: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				err = errors.Wrap(err, "error resetting session expiration")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 
+		// Websocket connections are tracked so that they can be closed when
+		// the session is revoked or the user loses access.
 		if c.isWebsocket(r) {
-			ws.ServeHTTP(w, r)
-			return
+			w = c.conns.Track(w, sessionID, username, expires, func() error {
+				return c.recheckWebsocket(req, sessionID, values)
+			})
 		}
-		rp.ServeHTTP(w, r)
+
+		backend.ServeHTTP(w, r)
 	}), nil
 }
 
-type originFlags []string
+// remoteIP returns the IP address of the client that connected to the proxy.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type listFlags []string
 
-func (o *originFlags) String() string {
+func (o *listFlags) String() string {
 	return strings.Join([]string(*o), ",")
 }
 
-func (o *originFlags) Set(s string) error {
+func (o *listFlags) Set(s string) error {
 	parts := strings.Split(s, ",")
 	*o = append(*o, parts...)
 	return nil
 }
 
+// pathPatterns is a list of path patterns, separated by commas on the command
+// line. Patterns use the syntax of path.Match, and a pattern that ends in a
+// slash also matches every path beneath it.
+type pathPatterns []string
+
+func (p *pathPatterns) String() string {
+	return strings.Join([]string(*p), ",")
+}
+
+func (p *pathPatterns) Set(s string) error {
+	for _, pattern := range strings.Split(s, ",") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid path pattern %s", pattern)
+		}
+		*p = append(*p, pattern)
+	}
+	return nil
+}
+
+// Match returns true if the URL path matches any of the patterns.
+func (p pathPatterns) Match(urlPath string) bool {
+	for _, pattern := range p {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(urlPath, pattern) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen-key" {
+		if err := genKey(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var (
-		corsOrigins    originFlags
+		corsOrigins    listFlags
+		gatewayPaths   pathPatterns
+		renewPaths     pathPatterns
+		basicPaths     pathPatterns
+		bindings       listFlags
+		sessionAttrs   listFlags
+		trustedProxies ipNets
+		casConfig      = &CASConfig{}
+		oidcConfig     = &OIDCConfig{}
+		bearerConfig   = &BearerConfig{}
+		configPath     = flag.String("config", "", "Path to a JSON file containing an object that maps flag names to values. Flags on the command line take precedence.")
+		authProvider   = flag.String("auth-provider", "cas", "The provider that users log in with. One of: cas, oidc.")
 		backendURL     = flag.String("backend-url", "http://localhost:60000", "The hostname and port to proxy requests to.")
 		wsbackendURL   = flag.String("ws-backend-url", "", "The backend URL for the handling websocket requests. Defaults to the value of --backend-url with a scheme of ws://")
 		frontendURL    = flag.String("frontend-url", "", "The URL for the frontend server. Might be different from the hostname and listen port.")
 		listenAddr     = flag.String("listen-addr", "0.0.0.0:8080", "The listen port number.")
-		casBase        = flag.String("cas-base-url", "", "The base URL to the CAS host.")
-		casValidate    = flag.String("cas-validate", "validate", "The CAS URL endpoint for validating tickets.")
 		maxAge         = flag.Int("max-age", 0, "The idle timeout for session, in seconds.")
+		idleTimeout    = flag.Duration("idle-timeout", 0, "How long a session lasts without any requests before the user has to log in again. Defaults to --max-age.")
+		maxLifetime    = flag.Duration("max-lifetime", 0, "How long a session lasts after logging in, no matter how active it is. Zero means there's no limit.")
 		sslCert        = flag.String("ssl-cert", "", "Path to the SSL .crt file.")
 		sslKey         = flag.String("ssl-key", "", "Path to the SSL .key file.")
 		ingressURL     = flag.String("ingress-url", "", "The URL to the cluster ingress.")
 		analysisHeader = flag.String("analysis-header", "get-analysis-id", "The Host header for the ingress service that gets the analysis ID.")
 		accessHeader   = flag.String("access-header", "check-resource-access", "The Host header for the ingress service that checks analysis access.")
 		externalID     = flag.String("external-id", "", "The external ID to pass to the apps service when looking up the analysis ID.")
+		reservedPrefix = flag.String("reserved-prefix", defaultReservedPrefix, "The path prefix for the endpoints handled by the proxy itself, such as logout. Requests under it are never forwarded to the backend.")
+		gatewayMaxAge  = flag.Duration("gateway-max-age", 5*time.Minute, "How long to forward requests for gateway paths anonymously after the provider reports that there's no single sign-on session.")
+		renewMaxAge    = flag.Duration("renew-max-age", 5*time.Minute, "How long a renewed login satisfies the requirement for --renew-paths.")
+		basicCacheTTL  = flag.Duration("basic-auth-cache-ttl", time.Minute, "How long accepted Basic credentials are remembered before they're checked with the provider again.")
+		keysFile       = flag.String("session-keys-file", "", "Path to a file with the session key pairs, one per line and newest first. Each line has a base64-encoded hash key, optionally followed by a base64-encoded block key. The newest pair encodes new cookies and the rest still decode old ones. Reloaded on SIGHUP.")
+		hashKeyFile    = flag.String("hash-key-file", "", "Path to a file containing the base64-encoded key that session cookies are signed with. Defaults to $"+hashKeyEnv+", or a random key. Generate one with the gen-key subcommand. Reloaded on SIGHUP.")
+		blockKeyFile   = flag.String("block-key-file", "", "Path to a file containing the base64-encoded AES key that session cookies are encrypted with. Defaults to $"+blockKeyEnv+", or a key derived from the hash key. Generate one with gen-key -type block. Reloaded on SIGHUP.")
+		acceptSigned   = flag.Bool("accept-signed-cookies", false, "Also accept session cookies that are signed but not encrypted, which were issued by older versions of the proxy, until the session keys are next reloaded. They're re-issued encrypted.")
+		backendType    = flag.String("session-backend", "cookie", "Where sessions are stored. One of: cookie, memory, file, redis. With anything but cookie, the cookie only holds a session ID.")
+		sessionDir     = flag.String("session-dir", "", "The directory that sessions are stored in with --session-backend file.")
+		redisAddr      = flag.String("redis-addr", "localhost:6379", "The host and port of the Redis server for --session-backend redis. The password, if any, is read from $"+redisPasswordEnv+".")
+		redisDB        = flag.Int("redis-db", 0, "The Redis database number for --session-backend redis.")
+		redisPrefix    = flag.String("redis-key-prefix", "cas-proxy:session:", "The prefix of the Redis keys that sessions are stored under.")
+		cookieName     = flag.String("cookie-name", "", "The name of the session cookie. Defaults to one derived from the analysis ID, so that analyses on the same domain don't share sessions.")
+		cookieDomain   = flag.String("cookie-domain", "", "The Domain attribute of the session cookie. Defaults to the host the cookie came from.")
+		cookiePath     = flag.String("cookie-path", "/", "The Path attribute of the session cookie.")
+		cookieSecure   = flag.String("cookie-secure", cookieSecureAuto, "Whether the session cookie is only sent over HTTPS. One of: auto, always, never. With auto, it's secure when the request was made over TLS or X-Forwarded-Proto is https.")
+		cookieSameSite = flag.String("cookie-samesite", "lax", "The SameSite attribute of the session cookie. One of: lax, strict, none, default. Default leaves the attribute out.")
+		cookieHTTPOnly = flag.Bool("cookie-http-only", true, "Whether the session cookie is hidden from scripts.")
+		bindingPolicy  = flag.String("session-binding-policy", bindingEnforce, "What happens when a session is used from a client that doesn't match --session-binding. One of: enforce, which makes the user log in again, or audit, which only logs it.")
+		bindingIPv4    = flag.Int("session-binding-ipv4-prefix", 24, "The prefix length of the IPv4 subnets that --session-binding subnet compares.")
+		bindingIPv6    = flag.Int("session-binding-ipv6-prefix", 64, "The prefix length of the IPv6 subnets that --session-binding subnet compares.")
+		authorizer     = flag.String("authorizer", "permissions", "What decides whether users can make requests. One of: permissions, which asks the permissions service, or file, which uses the rules in --authz-file. With file, --ingress-url and --external-id are optional.")
+		authzFile      = flag.String("authz-file", "", "Path to the JSON file with the allow and deny rules for --authorizer file. Reloaded when it changes.")
+		attrRulesFile  = flag.String("attribute-rules", "", "Path to a JSON file with rules about the attributes released by the provider, such as memberOf, eduPersonAffiliation, or the email domain. Users must match every all-of rule. Users who match an any-of rule get its level, read by default, unless the authorizer explicitly denies them.")
+		authzInterval  = flag.Duration("authz-reload-interval", 5*time.Second, "How often to check --authz-file for changes. Zero disables reloading.")
+		policyFile     = flag.String("access-policy", "", "Path to a JSON file that maps the permission levels read, write, admin, and own to the HTTP methods and path patterns they allow, with --authorizer permissions and the levels granted by --attribute-rules. Higher levels allow everything that lower ones do. The WEBSOCKET method matches websocket requests. By default, any level allows any request.")
+		allowCacheTTL  = flag.Duration("allow-cache-ttl", time.Minute, "How long to remember that a user is allowed to access the analysis. Zero disables caching these decisions.")
+		denyCacheTTL   = flag.Duration("deny-cache-ttl", 10*time.Second, "How long to remember that a user isn't allowed to access the analysis. Zero disables caching these decisions.")
+		cacheSize      = flag.Int("decision-cache-size", 10000, "The most permission decisions to cache at once. Zero disables the cache.")
+		wsRecheck      = flag.Duration("websocket-recheck-interval", time.Minute, "How often to check that the users of open websocket connections can still make them, closing the ones they can't. Permission decisions are cached for --allow-cache-ttl. Zero disables rechecking.")
+		adminAddr      = flag.String("admin-listen-addr", "", "The address to serve the admin API on, which lists and revokes sessions and flushes cached permission decisions. Sessions can only be listed with a server-side --session-backend. Disabled if empty.")
+		adminTokenFile = flag.String("admin-token-file", "", "Path to a file containing the bearer token that admin API requests must present. Defaults to $"+adminTokenEnv+".")
+		clockSkew      = flag.Duration("clock-skew", 30*time.Second, "The clock skew to tolerate when checking the validity period of SAML 1.1 assertions and ID tokens.")
 	)
 
 	flag.Var(&corsOrigins, "allowed-origins", "List of allowed origins, separated by commas.")
+	flag.Var(&gatewayPaths, "gateway-paths", "List of path patterns, separated by commas, that use an existing single sign-on session but don't require logging in.")
+	flag.Var(&renewPaths, "renew-paths", "List of path patterns, separated by commas, that require a recent primary login even if there's a single sign-on session.")
+	flag.Var(&basicPaths, "basic-auth-paths", "List of path patterns, separated by commas, that accept HTTP Basic credentials, which are checked with the provider. Only supported with --auth-provider cas.")
+	flag.Var(&sessionAttrs, "session-attributes", "List of the attributes released by the provider, separated by commas, that are kept in the session for authorization rules. Defaults to all of them. If they don't fit in the session cookie, none are kept.")
+	flag.Var(&bindings, "session-binding", "List of client characteristics, separated by commas, that sessions are bound to when the user logs in. Any of: ip, subnet, user-agent, tls-cert. The tls-cert binding requires --ssl-cert.")
+	flag.Var(&trustedProxies, "trusted-proxies", "List of the addresses or CIDR networks of the proxies in front of this one, separated by commas. The client's IP address is read from the X-Forwarded-For headers that they add.")
+	casConfig.AddFlags(flag.CommandLine)
+	oidcConfig.AddFlags(flag.CommandLine)
+	bearerConfig.AddFlags(flag.CommandLine)
 	flag.Parse()
 
-	if *casBase == "" {
-		log.Fatal("--cas-base-url must be set.")
+	if *configPath != "" {
+		if err := loadConfig(flag.CommandLine, *configPath); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if *frontendURL == "" {
 		log.Fatal("--frontend-url must be set.")
 	}
 
+	*reservedPrefix = path.Clean("/" + *reservedPrefix)
+	if *reservedPrefix == "/" {
+		log.Fatal("--reserved-prefix must not be /.")
+	}
+
+	if *idleTimeout == 0 {
+		*idleTimeout = time.Duration(*maxAge) * time.Second
+	}
+
 	useSSL := false
 	if *sslCert != "" || *sslKey != "" {
 		if *sslCert == "" {
@@ -546,7 +742,7 @@ func main() {
 	}
 
 	if len(corsOrigins) < 1 {
-		corsOrigins = originFlags{"*.cyverse.run", "*.cyverse.org", "*.cyverse.run:4343", "cyverse.run", "cyverse.run:4343"}
+		corsOrigins = listFlags{"*.cyverse.run", "*.cyverse.org", "*.cyverse.run:4343", "cyverse.run", "cyverse.run:4343"}
 	}
 
 	if *wsbackendURL == "" {
@@ -558,68 +754,279 @@ func main() {
 		*wsbackendURL = w.String()
 	}
 
-	if *ingressURL == "" {
-		log.Fatal("--ingress-url must be set.")
+	// The file authorizer doesn't need the apps or permissions services, so
+	// the analysis is only looked up if they're configured.
+	switch *authorizer {
+	case "permissions":
+		if *ingressURL == "" {
+			log.Fatal("--ingress-url must be set.")
+		}
+
+		if *externalID == "" {
+			log.Fatal("--external-id must be set.")
+		}
+	case "file":
+		if *authzFile == "" {
+			log.Fatal("--authz-file must be set with --authorizer file.")
+		}
+	default:
+		log.Fatalf("--authorizer must be one of: permissions, file, not %s", *authorizer)
+	}
+
+	binding, err := newSessionBinding(bindings, *bindingPolicy, *bindingIPv4, *bindingIPv6)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if binding != nil && binding.tlsCert && !useSSL {
+		log.Fatal("--session-binding tls-cert requires --ssl-cert and --ssl-key.")
+	}
+
+	cookieAttrs, err := newCookieAttributes(*cookieSecure, *cookieSameSite)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if *externalID == "" {
-		log.Fatal("--external-id must be set.")
+	var resourceName string
+	if *ingressURL != "" && *externalID != "" {
+		if resourceName, err = getResourceName(*ingressURL, *analysisHeader, *externalID); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *cookieName == "" {
+		*cookieName = sessionName
+		if resourceName != "" {
+			*cookieName += "-" + resourceName
+		}
 	}
 
 	log.Infof("backend URL is %s", *backendURL)
 	log.Infof("websocket backend URL is %s", *wsbackendURL)
 	log.Infof("frontend URL is %s", *frontendURL)
 	log.Infof("listen address is %s", *listenAddr)
-	log.Infof("CAS base URL is %s", *casBase)
-	log.Infof("CAS ticket validator endpoint is %s", *casValidate)
+	log.Infof("reserved path prefix is %s", *reservedPrefix)
+	log.Infof("session cookie name is %s", *cookieName)
 
 	for _, c := range corsOrigins {
 		log.Infof("Origin: %s\n", c)
 	}
 
-	authkey := make([]byte, 64)
-	_, err := rand.Read(authkey)
+	keyPairs, err := loadKeyPairs(*keysFile, *hashKeyFile, *blockKeyFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sessionStore := sessions.NewCookieStore(authkey)
-	sessionStore.Options = &sessions.Options{
-		Path:     "/",
+	reloadable := keyPairs != nil
+	if !reloadable {
+		log.Warnf("no session keys are configured, so sessions will end when the proxy restarts. Set --session-keys-file, --hash-key-file, or $%s to keep them.", hashKeyEnv)
+		pair, err := randomKeyPair()
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyPairs = []keyPair{pair}
+	}
+	log.Infof("loaded %d session key pairs", len(keyPairs))
+
+	cookieStore := newRotatingStore(keyPairs, &sessions.Options{
+		Path:     *cookiePath,
+		Domain:   *cookieDomain,
 		MaxAge:   *maxAge,
-		HttpOnly: true,
+		Secure:   *cookieSecure == cookieSecureAlways,
+		HttpOnly: *cookieHTTPOnly,
+	}, cookieAttrs, *acceptSigned)
+
+	// Rotating the keys is a matter of updating the key files and sending a
+	// SIGHUP.
+	if reloadable {
+		go reloadKeysOnHangup(cookieStore, *keysFile, *hashKeyFile, *blockKeyFile)
 	}
 
+	// Sessions are kept in the cookie itself unless a server-side backend is
+	// selected, in which case the cookie only holds the session ID.
+	var (
+		sessionStore   sessions.Store = cookieStore
+		sessionBackend SessionBackend
+	)
+	switch *backendType {
+	case "cookie":
+	case "memory":
+		sessionBackend = newMemoryBackend()
+	case "file":
+		if *sessionDir == "" {
+			log.Fatal("--session-dir must be set with --session-backend file.")
+		}
+		sessionBackend, err = newFileBackend(*sessionDir)
+	case "redis":
+		sessionBackend, err = newRedisBackend(*redisAddr, os.Getenv(redisPasswordEnv), *redisDB, *redisPrefix)
+	default:
+		err = fmt.Errorf("--session-backend must be one of: cookie, memory, file, redis, not %s", *backendType)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var serverSessions *serverStore
+	if sessionBackend != nil {
+		serverSessions = newServerStore(sessionBackend, cookieStore)
+		sessionStore = serverSessions
+	}
+	log.Infof("session backend is %s", *backendType)
+
+	loginStates := newLoginStateStore(cookieStore, *cookieName+"-login")
+
+	var auth Authenticator
+	switch *authProvider {
+	case "cas":
+		casConfig.FrontendURL = *frontendURL
+		casConfig.ReservedPrefix = *reservedPrefix
+		casConfig.RenewMaxAge = *renewMaxAge
+		casConfig.ClockSkew = *clockSkew
+		casConfig.LoginStates = loginStates
+		auth, err = NewCASAuthenticator(casConfig)
+	case "oidc":
+		oidcConfig.FrontendURL = *frontendURL
+		oidcConfig.ReservedPrefix = *reservedPrefix
+		oidcConfig.RenewMaxAge = *renewMaxAge
+		oidcConfig.ClockSkew = *clockSkew
+		oidcConfig.LoginStates = loginStates
+		auth, err = NewOIDCAuthenticator(oidcConfig)
+	default:
+		err = fmt.Errorf("--auth-provider must be one of: cas, oidc, not %s", *authProvider)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var bearer *BearerAuthenticator
+	if bearerConfig.Enabled() {
+		bearerConfig.ClockSkew = *clockSkew
+		if bearer, err = NewBearerAuthenticator(bearerConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var passwords PasswordAuthenticator
+	if len(basicPaths) > 0 {
+		var ok bool
+		if passwords, ok = auth.(PasswordAuthenticator); !ok {
+			log.Fatalf("--basic-auth-paths is not supported with --auth-provider %s", *authProvider)
+		}
+	}
+
+	bc, err := newBasicCache(*basicCacheTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		authz     Authorizer
+		policy    accessPolicy
+		decisions *decisionCache
+	)
+	if *policyFile != "" {
+		if policy, err = loadAccessPolicy(*policyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch *authorizer {
+	case "permissions":
+		if *cacheSize > 0 && (*allowCacheTTL > 0 || *denyCacheTTL > 0) {
+			decisions = newDecisionCache(*allowCacheTTL, *denyCacheTTL, *cacheSize)
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		authz = NewPermissionsAuthorizer(*ingressURL, *accessHeader, policy, decisions, client)
+	case "file":
+		if authz, err = NewFileAuthorizer(*authzFile, *authzInterval); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *attrRulesFile != "" {
+		rules, err := loadAttributeRules(*attrRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		authz = NewAttributeAuthorizer(authz, policy, rules)
+		log.Infof("loaded %d attribute rules", len(rules))
+	}
+	log.Infof("authorizer is %s", *authorizer)
+
 	p := &CASProxy{
-		casBase:        *casBase,
-		casValidate:    *casValidate,
-		frontendURL:    *frontendURL,
+		auth:           auth,
+		bearer:         bearer,
+		passwords:      passwords,
+		basicPaths:     basicPaths,
+		basicCache:     bc,
 		backendURL:     *backendURL,
 		wsbackendURL:   *wsbackendURL,
-		ingressURL:     *ingressURL,
-		accessHeader:   *accessHeader,
-		analysisHeader: *analysisHeader,
+		reservedPrefix: *reservedPrefix,
+		gatewayPaths:   gatewayPaths,
+		gatewayMaxAge:  *gatewayMaxAge,
+		renewPaths:     renewPaths,
+		renewMaxAge:    *renewMaxAge,
+		idleTimeout:    *idleTimeout,
+		maxLifetime:    *maxLifetime,
+		resourceName:   resourceName,
+		sessionName:    *cookieName,
+		sessionAttrs:   sessionAttrs,
 		sessionStore:   sessionStore,
+		cookies:        cookieStore,
+		tickets:        newTicketIndex(time.Duration(*maxAge) * time.Second),
+		conns:          newConnTracker(),
+		binding:        binding,
+		trustedProxies: trustedProxies,
+		authz:          authz,
+	}
+
+	if *wsRecheck > 0 {
+		go p.conns.watch(*wsRecheck)
+	}
+
+	// The admin API gets its own listener so that it can be kept off of the
+	// network that users reach the proxy from.
+	if *adminAddr != "" {
+		if serverSessions == nil {
+			log.Warn("sessions can't be listed or revoked through the admin API with --session-backend cookie")
+		}
+		token, err := loadAdminToken(*adminTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		admin := &http.Server{
+			Handler: NewAdminAPI(token, serverSessions, p.conns, decisions).Handler(),
+			Addr:    *adminAddr,
+		}
+		go func() {
+			var err error
+			log.Infof("admin API listen address is %s", *adminAddr)
+			if useSSL {
+				err = admin.ListenAndServeTLS(*sslCert, *sslKey)
+			} else {
+				err = admin.ListenAndServe()
+			}
+			log.Fatal(err)
+		}()
 	}
 
-	resourceName, err := p.getResourceName(*externalID)
+	proxy, err := p.Proxy()
 	if err != nil {
 		log.Fatal(err)
 	}
-	p.resourceName = resourceName
 
-	proxy, err := p.Proxy()
+	anonymous, err := p.AnonymousProxy()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	r := mux.NewRouter()
 
-	// If the query contains a ticket in the query params, then it needs to be
-	// validated.
+	// Callbacks from the provider are matched before the catch-all for the
+	// reserved prefix, since some providers return to a path beneath it.
 	r.PathPrefix("/url-ready").HandlerFunc(p.URLIsReady)
-	r.PathPrefix("/").Queries("ticket", "").Handler(http.HandlerFunc(p.ValidateTicket))
-	r.PathPrefix("/").MatcherFunc(p.Session).Handler(http.HandlerFunc(p.RedirectToCAS))
+	r.Path(path.Join(*reservedPrefix, logoutPath)).HandlerFunc(p.Logout)
+	p.auth.Routes(r, p)
+	r.PathPrefix("/").MatcherFunc(p.IsCallback).Handler(http.HandlerFunc(p.Callback))
+	r.PathPrefix(*reservedPrefix + "/").HandlerFunc(http.NotFound)
+	r.PathPrefix("/").MatcherFunc(p.Anonymous).Handler(anonymous)
+	r.PathPrefix("/").MatcherFunc(p.Session).Handler(http.HandlerFunc(p.Login))
 	r.PathPrefix("/").Handler(proxy)
 
 	c := cors.New(cors.Options{
@@ -627,10 +1034,27 @@ func main() {
 		AllowCredentials: true,
 	})
 
+	// The proxy's own endpoints are left out of CORS, so that pages on the
+	// allowed origins can't call them with the user's cookie.
+	prefix := *reservedPrefix + "/"
+	withCORS := c.Handler(r)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			r.ServeHTTP(w, req)
+			return
+		}
+		withCORS.ServeHTTP(w, req)
+	})
+
 	server := &http.Server{
-		Handler: c.Handler(r),
+		Handler: handler,
 		Addr:    *listenAddr,
 	}
+	// Clients are asked for certificates so that sessions can be bound to
+	// them, but they're only checked against the one used to log in.
+	if binding != nil && binding.tlsCert {
+		server.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
 	if useSSL {
 		err = server.ListenAndServeTLS(*sslCert, *sslKey)
 	} else {
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// oidcCallbackPath is the path, relative to the reserved prefix, that the
+// OpenID provider sends users back to after they log in.
+const oidcCallbackPath = "/oidc/callback"
+
+// oidcLoginTimeout is how long a user has to log in with the OpenID provider
+// before the login has to be started over.
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcRetryPrefix starts the state of logins that were restarted, so that the
+// callback doesn't restart them again. Random strings never contain a dot.
+const oidcRetryPrefix = "r."
+
+// oidcPassiveErrors are the error codes that the OpenID provider returns when
+// a login with prompt=none fails because the user would have to interact with
+// it.
+var oidcPassiveErrors = map[string]bool{
+	"login_required":             true,
+	"interaction_required":       true,
+	"consent_required":           true,
+	"account_selection_required": true,
+}
+
+// oidcProtocolClaims are the ID token claims that describe the token itself
+// rather than the user, so they aren't stored as attributes.
+var oidcProtocolClaims = map[string]bool{
+	"iss":           true,
+	"aud":           true,
+	"azp":           true,
+	"nonce":         true,
+	"at_hash":       true,
+	"c_hash":        true,
+	"sid":           true,
+	"typ":           true,
+	"session_state": true,
+}
+
+// oidcLogin is the state of a login with the OpenID provider that's in
+// progress, kept in a login state cookie between the redirect to the provider
+// and the callback.
+type oidcLogin struct {
+	State     string
+	Nonce     string
+	Verifier  string // The PKCE code verifier.
+	ReturnURL string
+	Options   LoginOptions
+	Started   int64
+}
+
+// OIDCConfig contains the settings for an OIDCAuthenticator.
+type OIDCConfig struct {
+	Issuer         string           // The issuer URL of the OpenID provider.
+	ClientID       string           // The client ID registered with the provider.
+	ClientSecret   string           // The client secret. Empty for public clients.
+	Scopes         listFlags        // The scopes to request.
+	UsernameClaim  string           // The ID token claim that contains the username.
+	FrontendURL    string           // The URL that users reach the proxy at.
+	ReservedPrefix string           // The path prefix for endpoints handled by the proxy itself.
+	RenewMaxAge    time.Duration    // How long a renewed login counts as recent.
+	ClockSkew      time.Duration    // The clock skew allowed when checking ID tokens.
+	LoginStates    *loginStateStore // Holds the state of logins in progress.
+}
+
+// AddFlags adds the command-line flags for the OpenID Connect settings to the
+// flag set. The settings shared with the rest of the proxy aren't included.
+func (cfg *OIDCConfig) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Issuer, "oidc-issuer", "", "The issuer URL of the OpenID provider. The discovery document is loaded from it.")
+	fs.StringVar(&cfg.ClientID, "oidc-client-id", "", "The client ID registered with the OpenID provider.")
+	fs.StringVar(&cfg.ClientSecret, "oidc-client-secret", "", "The client secret registered with the OpenID provider. Leave empty for public clients.")
+	fs.Var(&cfg.Scopes, "oidc-scopes", "List of scopes to request from the OpenID provider, separated by commas. Defaults to openid,profile,email.")
+	fs.StringVar(&cfg.UsernameClaim, "oidc-username-claim", "preferred_username", "The ID token claim that contains the username.")
+}
+
+// oidcDiscovery is the part of the OpenID provider's discovery document that
+// the proxy uses.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// OIDCAuthenticator is the Authenticator that logs users in with an OpenID
+// Connect provider using the authorization code flow with PKCE.
+type OIDCAuthenticator struct {
+	issuer         string
+	clientID       string
+	clientSecret   string
+	scopes         []string
+	usernameClaim  string
+	frontendURL    string
+	callbackURL    string // The redirect URI registered with the provider.
+	reservedPrefix string
+	renewMaxAge    time.Duration
+	clockSkew      time.Duration
+	loginStates    *loginStateStore
+	discovery      *oidcDiscovery
+	keys           *jwksKeys
+	client         *http.Client
+}
+
+// NewOIDCAuthenticator returns a newly instantiated *OIDCAuthenticator after
+// checking the configuration and loading the provider's discovery document.
+func NewOIDCAuthenticator(cfg *OIDCConfig) (*OIDCAuthenticator, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("--oidc-issuer must be set")
+	}
+
+	if cfg.ClientID == "" {
+		return nil, errors.New("--oidc-client-id must be set")
+	}
+
+	if cfg.UsernameClaim == "" {
+		return nil, errors.New("--oidc-username-claim must not be empty")
+	}
+
+	if cfg.LoginStates == nil {
+		return nil, errors.New("OpenID Connect logins need a login state store")
+	}
+
+	scopes := []string(cfg.Scopes)
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	hasOpenID := false
+	for _, s := range scopes {
+		if s == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	callbackURL, err := url.Parse(cfg.FrontendURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the frontend URL %s", cfg.FrontendURL)
+	}
+	callbackURL.Path = path.Join(callbackURL.Path, cfg.ReservedPrefix, oidcCallbackPath)
+	callbackURL.RawQuery = ""
+
+	a := &OIDCAuthenticator{
+		issuer:         strings.TrimSuffix(cfg.Issuer, "/"),
+		clientID:       cfg.ClientID,
+		clientSecret:   cfg.ClientSecret,
+		scopes:         scopes,
+		usernameClaim:  cfg.UsernameClaim,
+		frontendURL:    cfg.FrontendURL,
+		callbackURL:    callbackURL.String(),
+		reservedPrefix: cfg.ReservedPrefix,
+		renewMaxAge:    cfg.RenewMaxAge,
+		clockSkew:      cfg.ClockSkew,
+		loginStates:    cfg.LoginStates,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if err = a.discover(); err != nil {
+		return nil, err
+	}
+	a.keys = newJWKSKeys(a.discovery.JWKSURI, a.client)
+
+	log.Infof("OpenID issuer is %s", a.issuer)
+	log.Infof("OpenID authorization endpoint is %s", a.discovery.AuthorizationEndpoint)
+	log.Infof("OpenID token endpoint is %s", a.discovery.TokenEndpoint)
+	log.Infof("OpenID redirect URI is %s", a.callbackURL)
+
+	return a, nil
+}
+
+// discover loads the provider's discovery document.
+func (a *OIDCAuthenticator) discover() error {
+	u := a.issuer + "/.well-known/openid-configuration"
+	resp, err := a.client.Get(u)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch discovery document from %s", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("fetching discovery document from %s returned status code %d", u, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read discovery document from %s", u)
+	}
+
+	d := &oidcDiscovery{}
+	if err = json.Unmarshal(b, d); err != nil {
+		return errors.Wrapf(err, "failed to parse discovery document from %s", u)
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != a.issuer {
+		return fmt.Errorf("discovery document is for issuer %s, not %s", d.Issuer, a.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return fmt.Errorf("discovery document from %s is missing required endpoints", u)
+	}
+
+	a.discovery = d
+	return nil
+}
+
+// Routes doesn't add anything, since the callback is routed through
+// IsCallback.
+func (a *OIDCAuthenticator) Routes(r *mux.Router, p *CASProxy) {}
+
+// IsCallback returns true if the request is for the redirect URI.
+func (a *OIDCAuthenticator) IsCallback(r *http.Request) bool {
+	return r.URL.Path == path.Join(a.reservedPrefix, oidcCallbackPath)
+}
+
+// randomString returns n random bytes encoded with unpadded base64url, which
+// is the encoding that PKCE code verifiers need.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// LoginRedirect stores a new login state in a cookie and redirects the
+// request to the provider's authorization endpoint.
+func (a *OIDCAuthenticator) LoginRedirect(w http.ResponseWriter, r *http.Request, opts LoginOptions) {
+	returnURL, err := url.Parse(a.frontendURL)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse the frontend URL %s", a.frontendURL)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	retry := q.Get(loginRetryParam) != ""
+	q.Del(loginRetryParam)
+	returnURL.Path = r.URL.Path
+	returnURL.RawQuery = q.Encode()
+
+	login := oidcLogin{
+		ReturnURL: returnURL.String(),
+		Options:   opts,
+		Started:   time.Now().Unix(),
+	}
+	for _, v := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *v, err = randomString(32); err != nil {
+			err = errors.Wrap(err, "failed to generate login state")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if retry {
+		login.State = oidcRetryPrefix + login.State
+	}
+
+	if err = a.loginStates.save(w, r, login.State, &login); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := url.Parse(a.discovery.AuthorizationEndpoint)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse authorization endpoint %s", a.discovery.AuthorizationEndpoint)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q = authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", a.clientID)
+	q.Set("redirect_uri", a.callbackURL)
+	q.Set("scope", strings.Join(a.scopes, " "))
+	q.Set("state", login.State)
+	q.Set("nonce", login.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	// These are the OpenID equivalents of the renew and gateway parameters in
+	// CAS.
+	if opts.ForceReauth {
+		q.Set("prompt", "login")
+		q.Set("max_age", "0")
+	} else if opts.Passive {
+		q.Set("prompt", "none")
+	}
+	authURL.RawQuery = q.Encode()
+
+	http.Redirect(w, r, authURL.String(), http.StatusTemporaryRedirect)
+}
+
+// Callback checks the state returned by the provider against the login in
+// its cookie, exchanges the authorization code for tokens, and verifies the ID
+// token. The options for the login come from the cookie, since the callback
+// is always for the same path. If the login can't be matched to its state, it
+// starts over once.
+func (a *OIDCAuthenticator) Callback(w http.ResponseWriter, r *http.Request, _ LoginOptions) (*Identity, string, error) {
+	q := r.URL.Query()
+	state := q.Get("state")
+
+	login := &oidcLogin{}
+	err := a.checkLogin(w, r, state, login)
+	if err != nil {
+		if strings.HasPrefix(state, oidcRetryPrefix) {
+			return nil, "", err
+		}
+		log.Infof("restarting the login: %s", err)
+		returnURL, err := a.restartURL(login)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, returnURL, ErrRestartLogin
+	}
+
+	if e := q.Get("error"); e != "" {
+		if login.Options.Passive && oidcPassiveErrors[e] {
+			return nil, login.ReturnURL, ErrNotLoggedIn
+		}
+		return nil, "", fmt.Errorf("OpenID provider returned %s: %s", e, q.Get("error_description"))
+	}
+
+	code := q.Get("code")
+	if code == "" {
+		return nil, "", errors.New("callback did not include an authorization code")
+	}
+
+	rawIDToken, err := a.exchangeCode(code, login.Verifier)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "code exchange failed")
+	}
+
+	token, err := a.verifyIDToken(rawIDToken, login.Nonce)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "ID token verification failed")
+	}
+
+	username := token.stringClaim(a.usernameClaim)
+	if username == "" {
+		return nil, "", fmt.Errorf("ID token does not have a %s claim", a.usernameClaim)
+	}
+
+	if login.Options.ForceReauth {
+		authTime, ok := token.timeClaim("auth_time")
+		if !ok {
+			return nil, "", errors.New("ID token does not have an auth_time claim")
+		}
+		if time.Since(authTime) > a.renewMaxAge+a.clockSkew {
+			return nil, "", fmt.Errorf("ID token is for a login at %s, which is not recent enough", authTime.Format(time.RFC3339))
+		}
+	}
+
+	attrs := token.attributes()
+	for name := range oidcProtocolClaims {
+		delete(attrs, name)
+	}
+
+	return &Identity{
+		Username:        username,
+		Attributes:      attrs,
+		SessionIndex:    token.stringClaim("sid"),
+		Reauthenticated: login.Options.ForceReauth,
+	}, login.ReturnURL, nil
+}
+
+// restartURL returns the URL that a restarted login starts over from, marked
+// so that it isn't restarted again. Like CAS, it goes back to the URL that the
+// user originally asked for, if the login's cookie could be decoded even
+// though the login can't be finished. Otherwise it goes back to the frontend
+// URL, since the callback URL doesn't say where the user was going.
+func (a *OIDCAuthenticator) restartURL(login *oidcLogin) (string, error) {
+	target := a.frontendURL
+	if login.ReturnURL != "" && isUnder(login.ReturnURL, a.frontendURL) {
+		target = login.ReturnURL
+	}
+
+	returnURL, err := url.Parse(target)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse the return URL %s", target)
+	}
+	q := returnURL.Query()
+	q.Set(loginRetryParam, "1")
+	returnURL.RawQuery = q.Encode()
+	return returnURL.String(), nil
+}
+
+// checkLogin loads the login with the state from its cookie into login, and
+// checks that it's still valid. The state can only be used once.
+func (a *OIDCAuthenticator) checkLogin(w http.ResponseWriter, r *http.Request, state string, login *oidcLogin) error {
+	if state == "" {
+		return errors.New("the callback did not include a state")
+	}
+	if err := a.loginStates.load(w, r, state, login); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		return errors.New("state does not match the login in progress")
+	}
+
+	started := time.Unix(login.Started, 0)
+	if time.Since(started) > oidcLoginTimeout {
+		return errors.New("login took too long")
+	}
+
+	if !a.loginStates.use(state, started.Add(oidcLoginTimeout)) {
+		return errors.New("the login state was already used")
+	}
+	return nil
+}
+
+// exchangeCode redeems the authorization code at the token endpoint and
+// returns the ID token.
+func (a *OIDCAuthenticator) exchangeCode(code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", a.callbackURL)
+	form.Set("code_verifier", verifier)
+
+	// Confidential clients authenticate with client_secret_basic, which
+	// form-encodes the credentials before they're base64 encoded. Public
+	// clients only identify themselves.
+	if a.clientSecret == "" {
+		form.Set("client_id", a.clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if a.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading token response")
+	}
+
+	tr := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err = json.Unmarshal(b, &tr); err != nil {
+		return "", errors.Wrapf(err, "failed to parse token response with status code %d", resp.StatusCode)
+	}
+
+	if tr.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %s: %s", tr.Error, tr.ErrorDescription)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("token endpoint returned status code %d", resp.StatusCode)
+	}
+	if tr.IDToken == "" {
+		return "", errors.New("token response did not include an ID token")
+	}
+
+	return tr.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature against the provider's keys,
+// then checks its claims.
+func (a *OIDCAuthenticator) verifyIDToken(raw, nonce string) (*jwtToken, error) {
+	token, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := a.keys.Keys(token.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = token.verifyWithKeys(keys); err != nil {
+		return nil, err
+	}
+
+	if err = token.checkClaims(a.discovery.Issuer, a.clientID, time.Now(), a.clockSkew); err != nil {
+		return nil, err
+	}
+
+	// The authorized party has to be this client if the token was issued to
+	// more than one audience.
+	if azp := token.stringClaim("azp"); azp != "" && azp != a.clientID {
+		return nil, fmt.Errorf("token was issued to %s", azp)
+	}
+	if len(token.audience()) > 1 && token.stringClaim("azp") == "" {
+		return nil, errors.New("token has several audiences but no authorized party")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token.stringClaim("nonce")), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce does not match the login in progress")
+	}
+
+	return token, nil
+}
+
+// LogoutURL returns the provider's end session endpoint, or the service URL if
+// the provider doesn't have one. Service URLs that aren't under the frontend
+// URL are replaced with it, so that the endpoint can't redirect anywhere.
+func (a *OIDCAuthenticator) LogoutURL(service string) (string, error) {
+	service = checkLogoutService(service, a.frontendURL)
+
+	if a.discovery.EndSessionEndpoint == "" {
+		if service == "" {
+			return a.frontendURL, nil
+		}
+		return service, nil
+	}
+
+	logoutURL, err := url.Parse(a.discovery.EndSessionEndpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse end session endpoint %s", a.discovery.EndSessionEndpoint)
+	}
+
+	q := logoutURL.Query()
+	q.Set("client_id", a.clientID)
+	if service != "" {
+		q.Set("post_logout_redirect_uri", service)
+	}
+	logoutURL.RawQuery = q.Encode()
+	return logoutURL.String(), nil
+}
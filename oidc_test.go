@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	testFrontendURL = "https://proxy.example.org/app"
+	testClientID    = "cas-proxy"
+)
+
+// testProvider is a stub OpenID provider with a discovery document, a token
+// endpoint, and a key set. The authorization endpoint is never requested,
+// since tests act as the browser and make up the code themselves.
+type testProvider struct {
+	*httptest.Server
+	t          *testing.T
+	endSession string
+
+	// The login that the code is issued for, and how to sign its ID token.
+	code      string
+	challenge string
+	claims    map[string]interface{}
+	key       crypto.Signer
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	p := &testProvider{t: t, key: testRSAKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/auth",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+			"end_session_endpoint":   p.endSession,
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testJWKS(t, testJWK("k1", &testRSAKey.PublicKey)))
+	})
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// token checks the code and PKCE verifier and returns the ID token.
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		p.t.Error(err)
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("client_id") != testClientID,
+		r.PostForm.Get("code") != p.code,
+		base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"id_token": signTestJWT(p.t, "RS256", "k1", p.key, p.claims),
+	})
+}
+
+// newTestOIDC returns an authenticator for the provider.
+func newTestOIDC(t *testing.T, p *testProvider) *OIDCAuthenticator {
+	pair, err := randomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+	cookies := newRotatingStore([]keyPair{pair}, opts, cookieAttributes{secure: cookieSecureNever}, false)
+
+	a, err := NewOIDCAuthenticator(&OIDCConfig{
+		Issuer:         p.URL,
+		ClientID:       testClientID,
+		UsernameClaim:  "preferred_username",
+		FrontendURL:    testFrontendURL,
+		ReservedPrefix: defaultReservedPrefix,
+		RenewMaxAge:    time.Minute,
+		ClockSkew:      30 * time.Second,
+		LoginStates:    newLoginStateStore(cookies, "sid-login"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// startTestLogin redirects a request for the path to the provider, and
+// returns the authorization request's parameters and the cookies that were
+// set.
+func startTestLogin(t *testing.T, a *OIDCAuthenticator, target string, opts LoginOptions) (url.Values, []*http.Cookie) {
+	w := httptest.NewRecorder()
+	a.LoginRedirect(w, httptest.NewRequest(http.MethodGet, target, nil), opts)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected a redirect, got %d: %s", w.Code, w.Body)
+	}
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc.Query(), w.Result().Cookies()
+}
+
+// finishTestLogin sends the callback request with the query and cookies.
+func finishTestLogin(a *OIDCAuthenticator, query url.Values, cookies []*http.Cookie) (*Identity, string, error) {
+	r := httptest.NewRequest(http.MethodGet, a.callbackURL+"?"+query.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return a.Callback(httptest.NewRecorder(), r, LoginOptions{})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	a := newTestOIDC(t, p)
+
+	auth, cookies := startTestLogin(t, a, "/app/notebooks?x=1", LoginOptions{})
+	for name, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          "https://proxy.example.org/app/_cas-proxy/oidc/callback",
+		"scope":                 "openid profile email",
+		"code_challenge_method": "S256",
+	} {
+		if got := auth.Get(name); got != want {
+			t.Errorf("expected %s to be %q, got %q", name, want, got)
+		}
+	}
+
+	p.code = "c1"
+	p.challenge = auth.Get("code_challenge")
+	p.claims = map[string]interface{}{
+		"iss":                p.URL,
+		"aud":                testClientID,
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              auth.Get("nonce"),
+		"sid":                "s1",
+		"preferred_username": "alice",
+		"groups":             []string{"g1", "g2"},
+	}
+
+	id, returnURL, err := finishTestLogin(a, url.Values{"code": {"c1"}, "state": {auth.Get("state")}}, cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Username != "alice" || id.SessionIndex != "s1" {
+		t.Errorf("expected alice with session s1, got %+v", id)
+	}
+	if len(id.Attributes["groups"]) != 2 {
+		t.Errorf("expected the groups claim to be an attribute, got %v", id.Attributes)
+	}
+	if _, ok := id.Attributes["nonce"]; ok {
+		t.Error("expected protocol claims not to be attributes")
+	}
+	if want := testFrontendURL + "/notebooks?x=1"; returnURL != want {
+		t.Errorf("expected to return to %s, got %s", want, returnURL)
+	}
+
+	// The state can't be used twice, so the login starts over.
+	if _, _, err = finishTestLogin(a, url.Values{"code": {"c1"}, "state": {auth.Get("state")}}, cookies); err != ErrRestartLogin {
+		t.Errorf("expected a replayed state to restart the login, got %v", err)
+	}
+}
+
+func TestOIDCCallbackErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(p *testProvider, q url.Values)
+		err    string
+	}{
+		{"wrong nonce", func(p *testProvider, q url.Values) { p.claims["nonce"] = "other" }, "nonce does not match"},
+		{"wrong audience", func(p *testProvider, q url.Values) { p.claims["aud"] = "other" }, "not intended for " + testClientID},
+		{"wrong issuer", func(p *testProvider, q url.Values) { p.claims["iss"] = "https://evil.example.org" }, "token issuer"},
+		{"expired", func(p *testProvider, q url.Values) { p.claims["exp"] = time.Now().Add(-time.Hour).Unix() }, "token has expired"},
+		{"other authorized party", func(p *testProvider, q url.Values) { p.claims["azp"] = "other" }, "token was issued to other"},
+		{"wrong signing key", func(p *testProvider, q url.Values) { p.key = testOtherKey }, "token signature is invalid"},
+		{"wrong PKCE verifier", func(p *testProvider, q url.Values) { p.challenge = "other" }, "invalid_grant"},
+		{"wrong code", func(p *testProvider, q url.Values) { q.Set("code", "c2") }, "invalid_grant"},
+		{"no code", func(p *testProvider, q url.Values) { q.Del("code") }, "did not include an authorization code"},
+		{"provider error", func(p *testProvider, q url.Values) { q.Set("error", "access_denied") }, "OpenID provider returned access_denied"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvider(t)
+			defer p.Close()
+			a := newTestOIDC(t, p)
+
+			auth, cookies := startTestLogin(t, a, "/app/", LoginOptions{})
+			p.code = "c1"
+			p.challenge = auth.Get("code_challenge")
+			p.claims = map[string]interface{}{
+				"iss":                p.URL,
+				"aud":                testClientID,
+				"exp":                time.Now().Add(time.Minute).Unix(),
+				"nonce":              auth.Get("nonce"),
+				"preferred_username": "alice",
+			}
+
+			q := url.Values{"code": {"c1"}, "state": {auth.Get("state")}}
+			test.change(p, q)
+			_, _, err := finishTestLogin(a, q, cookies)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestOIDCRestartLogin(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	a := newTestOIDC(t, p)
+
+	// A callback without the state's cookie, such as from a link, restarts
+	// the login.
+	auth, _ := startTestLogin(t, a, "/app/", LoginOptions{})
+	_, returnURL, err := finishTestLogin(a, url.Values{"code": {"c1"}, "state": {auth.Get("state")}}, nil)
+	if err != ErrRestartLogin {
+		t.Fatalf("expected the login to restart, got %v", err)
+	}
+
+	// The callback doesn't say where the user was going without the cookie,
+	// so the login starts over at the frontend URL.
+	u, err := url.Parse(returnURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testFrontendURL + "?" + loginRetryParam + "=1"; returnURL != want {
+		t.Errorf("expected to restart at %s, got %s", want, returnURL)
+	}
+
+	// The restarted login is marked, and doesn't restart again.
+	auth, _ = startTestLogin(t, a, u.RequestURI(), LoginOptions{})
+	if !strings.HasPrefix(auth.Get("state"), oidcRetryPrefix) {
+		t.Errorf("expected the restarted login's state to start with %s, got %s", oidcRetryPrefix, auth.Get("state"))
+	}
+	if _, _, err = finishTestLogin(a, url.Values{"code": {"c1"}, "state": {auth.Get("state")}}, nil); err == nil || err == ErrRestartLogin {
+		t.Errorf("expected the restarted login to fail, got %v", err)
+	}
+}
+
+func TestOIDCRestartLoginKeepsURL(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	a := newTestOIDC(t, p)
+
+	// A login whose cookie can be decoded, but can't be finished, starts over
+	// at the URL that the user asked for.
+	auth, cookies := startTestLogin(t, a, "/app/notebooks?x=1", LoginOptions{})
+	a.loginStates.use(auth.Get("state"), time.Now().Add(time.Minute))
+	_, returnURL, err := finishTestLogin(a, url.Values{"code": {"c1"}, "state": {auth.Get("state")}}, cookies)
+	if err != ErrRestartLogin {
+		t.Fatalf("expected the login to restart, got %v", err)
+	}
+	u, err := url.Parse(returnURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testFrontendURL + "/notebooks"; u.Scheme+"://"+u.Host+u.Path != want || u.Query().Get("x") != "1" || u.Query().Get(loginRetryParam) == "" {
+		t.Errorf("expected to restart at %s?x=1 with the retry parameter, got %s", want, returnURL)
+	}
+
+	// Return URLs outside the frontend URL aren't followed.
+	login := &oidcLogin{ReturnURL: "https://evil.example.org/app/notebooks"}
+	if returnURL, err = a.restartURL(login); err != nil || !strings.HasPrefix(returnURL, testFrontendURL+"?") {
+		t.Errorf("expected to restart at the frontend URL, got %s, %v", returnURL, err)
+	}
+}
+
+func TestOIDCPassiveLogin(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.Close()
+	a := newTestOIDC(t, p)
+
+	auth, cookies := startTestLogin(t, a, "/app/public", LoginOptions{Passive: true})
+	if auth.Get("prompt") != "none" {
+		t.Errorf("expected a passive login to use prompt=none, got %q", auth.Get("prompt"))
+	}
+
+	_, returnURL, err := finishTestLogin(a, url.Values{"error": {"login_required"}, "state": {auth.Get("state")}}, cookies)
+	if err != ErrNotLoggedIn {
+		t.Fatalf("expected ErrNotLoggedIn, got %v", err)
+	}
+	if want := testFrontendURL + "/public"; returnURL != want {
+		t.Errorf("expected to return to %s, got %s", want, returnURL)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 "https://evil.example.org",
+			"authorization_endpoint": "https://evil.example.org/auth",
+			"token_endpoint":         "https://evil.example.org/token",
+			"jwks_uri":               "https://evil.example.org/jwks",
+		})
+	}))
+	defer srv.Close()
+
+	_, err := NewOIDCAuthenticator(&OIDCConfig{
+		Issuer:        srv.URL,
+		ClientID:      testClientID,
+		UsernameClaim: "preferred_username",
+		FrontendURL:   testFrontendURL,
+		LoginStates:   &loginStateStore{},
+	})
+	if err == nil || !strings.Contains(err.Error(), "discovery document is for issuer") {
+		t.Errorf("expected an issuer mismatch error, got %v", err)
+	}
+}
+
+func TestOIDCLogoutURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		endSession string
+		service    string
+		want       string
+	}{
+		{"no end session endpoint", "", testFrontendURL + "/bye", testFrontendURL + "/bye"},
+		{"no end session endpoint or service", "", "", testFrontendURL},
+		{"foreign service", "", "https://evil.example.org/", testFrontendURL},
+		{"look-alike host", "", "https://proxy.example.org.evil.example.org/app/", testFrontendURL},
+		{"sibling path", "", "https://proxy.example.org/application", testFrontendURL},
+		{"end session endpoint", "https://idp.example.org/logout", testFrontendURL + "/bye", "https://idp.example.org/logout?client_id=cas-proxy&post_logout_redirect_uri=https%3A%2F%2Fproxy.example.org%2Fapp%2Fbye"},
+		{"end session endpoint with foreign service", "https://idp.example.org/logout", "https://evil.example.org/", "https://idp.example.org/logout?client_id=cas-proxy"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProvider(t)
+			defer p.Close()
+			p.endSession = test.endSession
+			a := newTestOIDC(t, p)
+
+			got, err := a.LogoutURL(test.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pgtCallbackPath is the path, relative to the reserved prefix, that CAS sends
+// proxy-granting tickets to.
+const pgtCallbackPath = "/pgt-callback"
+
+// proxyTicketPath is the path, relative to the reserved prefix, that returns a
+// proxy ticket for a target service.
+const proxyTicketPath = "/proxy-ticket"
+
+// proxyTicketSecretHeader is the header that the backend sends the proxy
+// ticket secret in, which shows that the request came from the backend
+// rather than from a browser with the user's cookie.
+const proxyTicketSecretHeader = "X-Proxy-Ticket-Secret"
+
+// proxyTicketSecretEnv is the environment variable that the proxy ticket
+// secret is read from when --proxy-ticket-secret-file isn't set.
+const proxyTicketSecretEnv = "CAS_PROXY_TICKET_SECRET"
+
+// pgtIOUTimeout is how long a proxy-granting ticket delivered to the callback
+// endpoint is held while waiting for the ticket validation response that
+// references it.
+const pgtIOUTimeout = 2 * time.Minute
+
+// maxPGTStoreSize is the most unclaimed proxy-granting tickets that are held.
+// The callback endpoint isn't authenticated, so tickets that arrive when it's
+// full are dropped, rather than letting anyone make it grow.
+const maxPGTStoreSize = 1000
+
+// casProxyValidatePaths maps each protocol version to the path of the
+// validation endpoint that accepts proxy tickets and issues proxy-granting
+// tickets.
+var casProxyValidatePaths = map[string]string{
+	casProtocol2: "proxyValidate",
+	casProtocol3: "p3/proxyValidate",
+}
+
+type pgtEntry struct {
+	iou      string
+	pgt      string
+	received time.Time
+}
+
+// pgtStore holds the proxy-granting tickets that CAS sent to the callback
+// endpoint, keyed by their PGTIOU. CAS calls the callback before it responds
+// to the validation request, so the ticket is looked up by the PGTIOU in the
+// validation response. Tickets are only accepted while a validation is
+// waiting for its response, and they're forgotten once none are.
+type pgtStore struct {
+	mutex   sync.Mutex
+	pending int        // The number of validations waiting for a ticket.
+	order   *list.List // The entries, oldest first.
+	tickets map[string]*list.Element
+}
+
+func newPGTStore() *pgtStore {
+	return &pgtStore{
+		order:   list.New(),
+		tickets: map[string]*list.Element{},
+	}
+}
+
+// Expect records that a ticket validation that asks for a proxy-granting
+// ticket has started. The returned function must be called once, after the
+// ticket has been taken or the validation has failed.
+func (p *pgtStore) Expect() func() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pending++
+
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.pending--
+		if p.pending == 0 {
+			p.order.Init()
+			p.tickets = map[string]*list.Element{}
+		}
+	}
+}
+
+// remove forgets the entry. The mutex must be held.
+func (p *pgtStore) remove(e *list.Element) {
+	delete(p.tickets, e.Value.(*pgtEntry).iou)
+	p.order.Remove(e)
+}
+
+// prune forgets the entries that are older than pgtIOUTimeout. The mutex must
+// be held.
+func (p *pgtStore) prune(now time.Time) {
+	for e := p.order.Front(); e != nil; e = p.order.Front() {
+		if now.Sub(e.Value.(*pgtEntry).received) <= pgtIOUTimeout {
+			return
+		}
+		p.remove(e)
+	}
+}
+
+// Put records a PGTIOU/PGT pair, discarding any that were never claimed. It
+// returns false if the pair was dropped because no validation is waiting for
+// a ticket or the store is full.
+func (p *pgtStore) Put(iou, pgt string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.pending == 0 {
+		return false
+	}
+
+	now := time.Now()
+	p.prune(now)
+	if e, ok := p.tickets[iou]; ok {
+		p.remove(e)
+	}
+	if p.order.Len() >= maxPGTStoreSize {
+		return false
+	}
+
+	p.tickets[iou] = p.order.PushBack(&pgtEntry{
+		iou:      iou,
+		pgt:      pgt,
+		received: now,
+	})
+	return true
+}
+
+// Take returns and forgets the PGT associated with the PGTIOU.
+func (p *pgtStore) Take(iou string) (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, ok := p.tickets[iou]
+	if !ok {
+		return "", false
+	}
+	p.remove(e)
+
+	entry := e.Value.(*pgtEntry)
+	if time.Since(entry.received) > pgtIOUTimeout {
+		return "", false
+	}
+	return entry.pgt, true
+}
+
+// pgtCallbackURL returns the URL that CAS should deliver proxy-granting
+// tickets to.
+func (a *CASAuthenticator) pgtCallbackURL() (string, error) {
+	u, err := url.Parse(a.frontendURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse the frontend URL %s", a.frontendURL)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("the proxy-granting ticket callback must use https, but the frontend URL is %s", a.frontendURL)
+	}
+	u.Path = path.Join(u.Path, a.reservedPrefix, pgtCallbackPath)
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// checkProxies makes sure that every service in the proxy chain of a proxy
+// ticket is allowed to proxy for this service.
+func (a *CASAuthenticator) checkProxies(proxies []string) error {
+	for _, p := range proxies {
+		allowed := false
+		for _, ap := range a.allowedProxies {
+			if p == ap {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("proxy %s is not allowed", p)
+		}
+	}
+	return nil
+}
+
+// PGTCallback receives proxy-granting tickets from the CAS server. CAS makes
+// a request without any parameters to check that the endpoint is reachable,
+// so a request without a ticket still gets a successful response, and so does
+// one with a ticket that nothing was waiting for.
+func (a *CASAuthenticator) PGTCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	iou := q.Get("pgtIou")
+	pgt := q.Get("pgtId")
+	if iou != "" && pgt != "" && !a.pgts.Put(iou, pgt) {
+		log.Debugf("dropped the proxy-granting ticket for PGTIOU %s", iou)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// allowedTarget returns true if the backend can get proxy tickets for the
+// service.
+func (a *CASAuthenticator) allowedTarget(service string) bool {
+	for _, t := range a.proxyTargets {
+		if service == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(service, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// casProxyResponse is the XML document returned by the CAS proxy endpoint.
+type casProxyResponse struct {
+	XMLName xml.Name `xml:"serviceResponse"`
+	Success *struct {
+		ProxyTicket string `xml:"proxyTicket"`
+	} `xml:"proxySuccess"`
+	Failure *casAuthFailure `xml:"proxyFailure"`
+}
+
+// requestProxyTicket asks CAS for a proxy ticket for the target service using
+// a proxy-granting ticket.
+func (a *CASAuthenticator) requestProxyTicket(pgt, targetService string) (string, error) {
+	casURL, err := url.Parse(a.casBase)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to parse CAS base URL %s", a.casBase)
+	}
+
+	casURL.Path = path.Join(casURL.Path, "proxy")
+	q := casURL.Query()
+	q.Add("pgt", pgt)
+	q.Add("targetService", targetService)
+	casURL.RawQuery = q.Encode()
+
+	resp, err := http.Get(casURL.String())
+	if err != nil {
+		return "", errors.Wrap(err, "proxy ticket request error")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("proxy ticket request status code was %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading body of CAS response")
+	}
+
+	pr := &casProxyResponse{}
+	if err = xml.Unmarshal(b, pr); err != nil {
+		return "", errors.Wrap(err, "error parsing CAS proxy response")
+	}
+
+	if pr.Failure != nil {
+		return "", fmt.Errorf("proxy ticket request failed with code %s: %s", pr.Failure.Code, strings.TrimSpace(pr.Failure.Message))
+	}
+
+	if pr.Success == nil || strings.TrimSpace(pr.Success.ProxyTicket) == "" {
+		return "", errors.New("CAS proxy response did not contain a proxy ticket")
+	}
+
+	return strings.TrimSpace(pr.Success.ProxyTicket), nil
+}
+
+// ProxyTicket returns a handler that writes out a JSON-encoded response in
+// the format {"ticket":string} containing a fresh proxy ticket for the service
+// in the targetService query parameter, which must be one of the allowed
+// targets. The request has to carry the user's session cookie, so the backend
+// should forward the cookie it received from the user, along with the proxy
+// ticket secret, which the user's browser doesn't have.
+func (a *CASAuthenticator) ProxyTicket(p *CASProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(proxyTicketSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), a.proxySecret) != 1 {
+			http.Error(w, "invalid proxy ticket secret", http.StatusUnauthorized)
+			return
+		}
+
+		targetService := r.URL.Query().Get("targetService")
+		if targetService == "" {
+			http.Error(w, "targetService must be set", http.StatusBadRequest)
+			return
+		}
+		if !a.allowedTarget(targetService) {
+			http.Error(w, "proxy tickets can't be issued for "+targetService, http.StatusForbidden)
+			return
+		}
+
+		session, err := p.activeSession(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		pgt, ok := session.Values[sessionPGT].(string)
+		if !ok || pgt == "" {
+			http.Error(w, "no proxy-granting ticket is associated with the session", http.StatusForbidden)
+			return
+		}
+
+		ticket, err := a.requestProxyTicket(pgt, targetService)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		body, err := json.Marshal(map[string]string{
+			"ticket": ticket,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// testCAS is a stub CAS server that validates ST-1 for alice and issues PT-1
+// for PGT-1. Like CAS, it delivers the proxy-granting ticket to the callback
+// before it responds to the validation request. Its REST API issues TGT-1 for
+// alice's password, which is "secret", and ST-1 for TGT-1.
+type testCAS struct {
+	*httptest.Server
+	callback  http.HandlerFunc // Receives the proxy-granting tickets.
+	pgtURLs   []string         // The pgtUrl parameters of the validation requests.
+	logins    int              // The number of ticket-granting ticket requests.
+	destroyed []string         // The ticket-granting tickets that were deleted.
+}
+
+func newTestCAS(t *testing.T) *testCAS {
+	c := &testCAS{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cas/proxyValidate", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		c.pgtURLs = append(c.pgtURLs, q.Get("pgtUrl"))
+		if q.Get("ticket") != "ST-1" {
+			fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:authenticationFailure code="INVALID_TICKET">not valid</cas:authenticationFailure></cas:serviceResponse>`)
+			return
+		}
+
+		iou := ""
+		if q.Get("pgtUrl") != "" {
+			iou = "PGTIOU-1"
+			cb := url.Values{"pgtIou": {iou}, "pgtId": {"PGT-1"}}
+			c.callback(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, q.Get("pgtUrl")+"?"+cb.Encode(), nil))
+		}
+		fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess>
+    <cas:user>alice</cas:user>
+    <cas:proxyGrantingTicket>%s</cas:proxyGrantingTicket>
+  </cas:authenticationSuccess>
+</cas:serviceResponse>`, iou)
+	})
+	mux.HandleFunc("/cas/proxy", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("pgt") != "PGT-1" {
+			fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:proxyFailure code="INVALID_TICKET">unknown ticket</cas:proxyFailure></cas:serviceResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas"><cas:proxySuccess><cas:proxyTicket>PT-1</cas:proxyTicket></cas:proxySuccess></cas:serviceResponse>`)
+	})
+	mux.HandleFunc("/cas/v1/tickets", func(w http.ResponseWriter, r *http.Request) {
+		c.logins++
+		if r.FormValue("username") != "alice" || r.FormValue("password") != "secret" {
+			http.Error(w, "authentication failed", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Location", c.URL+"/cas/v1/tickets/TGT-1")
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/cas/v1/tickets/TGT-1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			c.destroyed = append(c.destroyed, "TGT-1")
+			return
+		}
+		fmt.Fprint(w, "ST-1")
+	})
+	c.Server = httptest.NewServer(mux)
+	return c
+}
+
+// newTestPGTAuthenticator returns an authenticator that gets proxy tickets
+// from the stub CAS server.
+func newTestPGTAuthenticator(c *testCAS) *CASAuthenticator {
+	a := &CASAuthenticator{
+		casBase:      c.URL + "/cas",
+		casValidate:  "proxyValidate",
+		casProtocol:  casProtocol3,
+		pgtURL:       "https://proxy.example.org/_cas-proxy/pgt-callback",
+		proxyTargets: []string{"https://svc.example.org/api/", "https://other.example.org"},
+		proxySecret:  []byte("backend secret"),
+		frontendURL:  "https://proxy.example.org",
+		pgts:         newPGTStore(),
+	}
+	c.callback = a.PGTCallback
+	return a
+}
+
+func TestPGTStore(t *testing.T) {
+	p := newPGTStore()
+
+	// Nothing is accepted unless a validation is waiting for it.
+	if p.Put("PGTIOU-1", "PGT-1") {
+		t.Error("expected a ticket that nothing is waiting for to be dropped")
+	}
+
+	done := p.Expect()
+	if !p.Put("PGTIOU-1", "PGT-1") {
+		t.Fatal("expected the ticket to be accepted while a validation is pending")
+	}
+	if pgt, ok := p.Take("PGTIOU-1"); !ok || pgt != "PGT-1" {
+		t.Errorf("expected PGT-1, got %q, %t", pgt, ok)
+	}
+	if _, ok := p.Take("PGTIOU-1"); ok {
+		t.Error("expected a ticket to only be taken once")
+	}
+
+	// Expired tickets can't be taken, and they're pruned by later puts.
+	p.Put("PGTIOU-old", "PGT-old")
+	p.tickets["PGTIOU-old"].Value.(*pgtEntry).received = time.Now().Add(-2 * pgtIOUTimeout)
+	p.Put("PGTIOU-2", "PGT-2")
+	if _, ok := p.tickets["PGTIOU-old"]; ok {
+		t.Error("expected the expired ticket to be pruned")
+	}
+	p.tickets["PGTIOU-2"].Value.(*pgtEntry).received = time.Now().Add(-2 * pgtIOUTimeout)
+	if _, ok := p.Take("PGTIOU-2"); ok {
+		t.Error("expected an expired ticket not to be taken")
+	}
+
+	// Once the store is full, new tickets are dropped.
+	for i := 0; i < maxPGTStoreSize; i++ {
+		p.Put(fmt.Sprintf("PGTIOU-fill-%d", i), "PGT")
+	}
+	if p.Put("PGTIOU-3", "PGT-3") {
+		t.Error("expected a ticket to be dropped when the store is full")
+	}
+	if p.order.Len() != maxPGTStoreSize || len(p.tickets) != maxPGTStoreSize {
+		t.Errorf("expected %d tickets, got %d in the list and %d in the map", maxPGTStoreSize, p.order.Len(), len(p.tickets))
+	}
+
+	// Unclaimed tickets are forgotten once no validation is pending.
+	done()
+	if p.order.Len() != 0 || len(p.tickets) != 0 {
+		t.Errorf("expected the store to be empty, got %d tickets", p.order.Len())
+	}
+	if p.Put("PGTIOU-4", "PGT-4") {
+		t.Error("expected a ticket to be dropped once no validation is pending")
+	}
+}
+
+func TestCallbackTakesPGT(t *testing.T) {
+	c := newTestCAS(t)
+	defer c.Close()
+	a := newTestPGTAuthenticator(c)
+
+	r := httptest.NewRequest(http.MethodGet, "https://proxy.example.org/app?ticket=ST-1", nil)
+	id, _, err := a.Callback(httptest.NewRecorder(), r, LoginOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Extra[sessionPGT] != "PGT-1" {
+		t.Errorf("expected the session to get PGT-1, got %q", id.Extra[sessionPGT])
+	}
+	if len(c.pgtURLs) != 1 || c.pgtURLs[0] != a.pgtURL {
+		t.Errorf("expected the validation to ask for a proxy-granting ticket, got %v", c.pgtURLs)
+	}
+	if a.pgts.pending != 0 || a.pgts.order.Len() != 0 {
+		t.Errorf("expected nothing to be pending or held, got %d pending and %d held", a.pgts.pending, a.pgts.order.Len())
+	}
+
+	// Tickets sent to the callback outside of a validation are dropped.
+	cb := httptest.NewRecorder()
+	a.PGTCallback(cb, httptest.NewRequest(http.MethodGet, a.pgtURL+"?pgtIou=PGTIOU-x&pgtId=PGT-x", nil))
+	if cb.Code != http.StatusOK {
+		t.Errorf("expected the callback to succeed, got %d", cb.Code)
+	}
+	if _, ok := a.pgts.Take("PGTIOU-x"); ok {
+		t.Error("expected an unexpected ticket to be dropped")
+	}
+}
+
+func TestProxyTicket(t *testing.T) {
+	c := newTestCAS(t)
+	defer c.Close()
+	a := newTestPGTAuthenticator(c)
+
+	opts := &sessions.Options{Path: "/", MaxAge: 3600}
+	pair, err := randomKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &CASProxy{
+		sessionName:  "proxy-session",
+		sessionStore: newRotatingStore([]keyPair{pair}, opts, cookieAttributes{}, false),
+		tickets:      newTicketIndex(0),
+	}
+
+	// sessionCookies returns the cookies for a session with the PGT.
+	sessionCookies := func(pgt string) []*http.Cookie {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		s, err := p.sessionStore.New(r, p.sessionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Values[sessionKey] = "alice"
+		if pgt != "" {
+			s.Values[sessionPGT] = pgt
+		}
+		w := httptest.NewRecorder()
+		if err = s.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		return w.Result().Cookies()
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		target  string
+		cookies []*http.Cookie
+		status  int
+	}{
+		{"success", "backend secret", "https://svc.example.org/api/v1", sessionCookies("PGT-1"), http.StatusOK},
+		{"exact target", "backend secret", "https://other.example.org", sessionCookies("PGT-1"), http.StatusOK},
+		{"missing secret", "", "https://svc.example.org/api/v1", sessionCookies("PGT-1"), http.StatusUnauthorized},
+		{"wrong secret", "backend", "https://svc.example.org/api/v1", sessionCookies("PGT-1"), http.StatusUnauthorized},
+		{"missing target", "backend secret", "", sessionCookies("PGT-1"), http.StatusBadRequest},
+		{"target outside the list", "backend secret", "https://evil.example.org/", sessionCookies("PGT-1"), http.StatusForbidden},
+		{"target that only shares a prefix", "backend secret", "https://svc.example.org/apiary", sessionCookies("PGT-1"), http.StatusForbidden},
+		{"target beneath an exact target", "backend secret", "https://other.example.org/x", sessionCookies("PGT-1"), http.StatusForbidden},
+		{"no session", "backend secret", "https://svc.example.org/api/v1", nil, http.StatusForbidden},
+		{"no PGT", "backend secret", "https://svc.example.org/api/v1", sessionCookies(""), http.StatusForbidden},
+		{"PGT rejected by CAS", "backend secret", "https://svc.example.org/api/v1", sessionCookies("PGT-2"), http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := url.Values{}
+			if test.target != "" {
+				q.Set("targetService", test.target)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/_cas-proxy/proxy-ticket?"+q.Encode(), nil)
+			if test.secret != "" {
+				r.Header.Set(proxyTicketSecretHeader, test.secret)
+			}
+			for _, c := range test.cookies {
+				r.AddCookie(c)
+			}
+
+			w := httptest.NewRecorder()
+			a.ProxyTicket(p).ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			body := map[string]string{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body["ticket"] != "PT-1" {
+				t.Errorf("expected PT-1, got %q", body["ticket"])
+			}
+		})
+	}
+}
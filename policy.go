@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// websocketMethod is the pseudo-method that access policies use for websocket
+// upgrade requests, so that opening a websocket can be allowed separately from
+// other GET requests.
+const websocketMethod = "WEBSOCKET"
+
+// permissionLevels are the levels that the permissions service grants, from
+// the least access to the most. Each level can do everything that the levels
+// before it can.
+var permissionLevels = []string{"read", "write", "admin", "own"}
+
+// levelRank returns the position of the level in permissionLevels, or -1 if
+// it isn't one of them.
+func levelRank(level string) int {
+	for i, l := range permissionLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// highestLevel returns the level that grants the most access. Levels that
+// aren't known are only returned if there aren't any known ones, so that they
+// still count as having some access when there isn't a policy.
+func highestLevel(levels []string) string {
+	best := ""
+	for _, level := range levels {
+		if level == "" {
+			continue
+		}
+		if best == "" || levelRank(level) > levelRank(best) {
+			best = level
+		}
+	}
+	return best
+}
+
+// accessRule allows requests with any of the methods for any of the paths.
+// An empty list of methods or paths matches all of them, as does a method of
+// "*", although it doesn't match websocket requests.
+type accessRule struct {
+	Methods []string     `json:"methods"`
+	Paths   pathPatterns `json:"paths"`
+}
+
+func (r accessRule) matches(method, urlPath string) bool {
+	if len(r.Paths) > 0 && !r.Paths.Match(urlPath) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method || (m == "*" && method != websocketMethod) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessPolicy maps permission levels to the requests that they allow. A
+// request is allowed for a level if a rule for that level or a lower one
+// matches it.
+type accessPolicy map[string][]accessRule
+
+// loadAccessPolicy reads the policy from a JSON file with an object that maps
+// permission levels to lists of rules, such as:
+//
+//	{
+//	  "read": [{"methods": ["GET", "HEAD"]}],
+//	  "write": [{"methods": ["*", "WEBSOCKET"]}]
+//	}
+func loadAccessPolicy(file string) (accessPolicy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read access policy %s", file)
+	}
+
+	policy := accessPolicy{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err = d.Decode(&policy); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse access policy %s", file)
+	}
+
+	for level, rules := range policy {
+		if levelRank(level) < 0 {
+			return nil, fmt.Errorf("unknown permission level %s in access policy %s. Must be one of: %s", level, file, strings.Join(permissionLevels, ", "))
+		}
+		for i := range rules {
+			for j, m := range rules[i].Methods {
+				rules[i].Methods[j] = strings.ToUpper(m)
+			}
+			for _, pattern := range rules[i].Paths {
+				if _, err = path.Match(pattern, ""); err != nil {
+					return nil, errors.Wrapf(err, "invalid path pattern %s for %s in access policy %s", pattern, level, file)
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// requestMethod returns the method that access policies match the request
+// with.
+func (c *CASProxy) requestMethod(r *http.Request) string {
+	if c.isWebsocket(r) {
+		return websocketMethod
+	}
+	return r.Method
+}
+
+// RequiredLevel returns the lowest permission level that allows the request,
+// or an empty string if none of them do.
+func (p accessPolicy) RequiredLevel(method, urlPath string) string {
+	for _, level := range permissionLevels {
+		for _, rule := range p[level] {
+			if rule.matches(method, urlPath) {
+				return level
+			}
+		}
+	}
+	return ""
+}
+
+// Decide allows the request if the user's permission level is enough for it,
+// and otherwise says which level it requires. Without a policy, any level
+// allows any request.
+func (p accessPolicy) Decide(req *AccessRequest, level string) *Decision {
+	if level == "" {
+		return deny("%s has no access to the analysis", req.Username)
+	}
+	if p == nil {
+		return allow()
+	}
+
+	required := p.RequiredLevel(req.Method, req.Path)
+	if required == "" {
+		return deny("no permission level allows %s %s", req.Method, req.Path)
+	}
+	if levelRank(level) < levelRank(required) {
+		return deny("%s %s requires %s access, but %s has %s access", req.Method, req.Path, required, req.Username, level)
+	}
+	return allow()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPolicy lets readers GET and HEAD anything, writers use the API and
+// files and open websockets at /ws, and admins do anything under /admin/.
+var testPolicy = accessPolicy{
+	"read":  {{Methods: []string{"GET", "HEAD"}}},
+	"write": {{Methods: []string{"*", websocketMethod}, Paths: pathPatterns{"/api/", "/files/*", "/ws"}}},
+	"admin": {{Paths: pathPatterns{"/admin/"}}},
+}
+
+func TestLevelRank(t *testing.T) {
+	for i, level := range []string{"read", "write", "admin", "own"} {
+		if r := levelRank(level); r != i {
+			t.Errorf("expected %s to rank %d, got %d", level, i, r)
+		}
+	}
+	if r := levelRank("superuser"); r != -1 {
+		t.Errorf("expected an unknown level to rank -1, got %d", r)
+	}
+}
+
+func TestHighestLevel(t *testing.T) {
+	tests := []struct {
+		levels []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{""}, ""},
+		{[]string{"read"}, "read"},
+		{[]string{"read", "own", "write"}, "own"},
+		{[]string{"", "write", "read"}, "write"},
+		{[]string{"custom"}, "custom"},
+		{[]string{"custom", "read"}, "read"},
+		{[]string{"read", "custom"}, "read"},
+	}
+
+	for _, test := range tests {
+		if got := highestLevel(test.levels); got != test.want {
+			t.Errorf("%v: expected %q, got %q", test.levels, test.want, got)
+		}
+	}
+}
+
+func TestRequiredLevel(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/", "read"},
+		{"HEAD", "/api/v1", "read"},
+		{"GET", "/admin/users", "read"}, // Read rules don't have paths, so they match everywhere.
+		{"POST", "/api/v1", "write"},
+		{"DELETE", "/files/a.txt", "write"},
+		{"DELETE", "/files/dir/a.txt", ""}, // * doesn't match slashes.
+		{websocketMethod, "/ws", "write"},
+		{websocketMethod, "/api/ws", "write"},
+		{"POST", "/admin/users", "admin"},
+		{websocketMethod, "/admin/ws", "admin"},
+		{"POST", "/other", ""},
+	}
+
+	for _, test := range tests {
+		if got := testPolicy.RequiredLevel(test.method, test.path); got != test.want {
+			t.Errorf("%s %s: expected %q, got %q", test.method, test.path, test.want, got)
+		}
+	}
+
+	// Nothing is allowed without a matching rule, and "*" doesn't match
+	// websockets.
+	p := accessPolicy{"read": {{Methods: []string{"*"}, Paths: pathPatterns{"/app/"}}}}
+	for _, test := range []struct{ method, path string }{{"GET", "/other"}, {websocketMethod, "/app/ws"}} {
+		if got := p.RequiredLevel(test.method, test.path); got != "" {
+			t.Errorf("%s %s: expected no level to allow it, got %q", test.method, test.path, got)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy accessPolicy
+		method string
+		path   string
+		level  string
+		reason string // Empty if the request is allowed.
+	}{
+		{"no level", testPolicy, "GET", "/", "", "alice has no access"},
+		{"no level without a policy", nil, "GET", "/", "", "alice has no access"},
+		{"any level without a policy", nil, "DELETE", "/admin/users", "read", ""},
+		{"unknown level without a policy", nil, "POST", "/", "custom", ""},
+		{"enough", testPolicy, "GET", "/", "read", ""},
+		{"more than enough", testPolicy, "POST", "/api/v1", "own", ""},
+		{"not enough", testPolicy, "POST", "/api/v1", "read", "requires write access, but alice has read access"},
+		{"websocket", testPolicy, websocketMethod, "/ws", "read", "requires write access"},
+		{"unknown level with a policy", testPolicy, "GET", "/", "custom", "requires read access, but alice has custom access"},
+		{"nothing allows it", testPolicy, "POST", "/other", "own", "no permission level allows POST /other"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &AccessRequest{Username: "alice", Method: test.method, Path: test.path}
+			d := test.policy.Decide(req, test.level)
+			if d.Allowed != (test.reason == "") {
+				t.Fatalf("expected allowed to be %t, got %+v", test.reason == "", d)
+			}
+			if !strings.Contains(d.Reason, test.reason) {
+				t.Errorf("expected a reason containing %q, got %q", test.reason, d.Reason)
+			}
+		})
+	}
+}
+
+func TestRequestMethod(t *testing.T) {
+	c := &CASProxy{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if m := c.requestMethod(r); m != http.MethodGet {
+		t.Errorf("expected GET, got %s", m)
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if m := c.requestMethod(r); m != websocketMethod {
+		t.Errorf("expected %s, got %s", websocketMethod, m)
+	}
+}
+
+func TestLoadAccessPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{"valid", `{"read": [{"methods": ["get", "head"]}], "write": [{"methods": ["*"], "paths": ["/api/"]}]}`, ""},
+		{"unknown level", `{"superuser": [{}]}`, "unknown permission level superuser"},
+		{"unknown field", `{"read": [{"method": ["GET"]}]}`, "failed to parse"},
+		{"bad pattern", `{"read": [{"paths": ["/["]}]}`, "invalid path pattern"},
+		{"not JSON", `read: GET`, "failed to parse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, "policy.json")
+			if err := ioutil.WriteFile(file, []byte(test.policy), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := loadAccessPolicy(file)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Methods are matched in upper case.
+			if got := p.RequiredLevel("HEAD", "/"); got != "read" {
+				t.Errorf("expected HEAD to need read access, got %q", got)
+			}
+		})
+	}
+
+	if _, err := loadAccessPolicy(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected a missing file to be an error")
+	}
+}
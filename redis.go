@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redisPasswordEnv is the environment variable that the Redis password is read
+// from, so that it doesn't show up in the process list.
+const redisPasswordEnv = "CAS_PROXY_REDIS_PASSWORD"
+
+// redisTimeout is how long a single command to the Redis server can take.
+const redisTimeout = 5 * time.Second
+
+// redisMaxIdle is the number of idle connections kept open to the Redis
+// server.
+const redisMaxIdle = 8
+
+// redisError is an error reply from the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn is a connection that speaks just enough of the Redis
+// serialization protocol for the session backend.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// do sends the command and returns the reply. Replies are strings, int64s,
+// []byte for bulk strings, nil for null bulk strings, or []interface{} for
+// arrays. Error replies are returned as redisError.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("malformed reply from Redis")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed bulk string length from Redis")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed array length from Redis")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("unknown reply type %q from Redis", line[0])
+}
+
+// redisBackend is a SessionBackend that keeps sessions in a Redis server, or
+// anything else that speaks its protocol. Sessions expire through Redis key
+// expiration.
+type redisBackend struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	idle     chan *redisConn
+}
+
+func newRedisBackend(addr, password string, db int, prefix string) (*redisBackend, error) {
+	b := &redisBackend{
+		addr:     addr,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		idle:     make(chan *redisConn, redisMaxIdle),
+	}
+
+	// Fail at startup instead of on the first request if the server can't be
+	// reached.
+	if _, err := b.do("PING"); err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to Redis at %s", addr)
+	}
+	return b, nil
+}
+
+func (b *redisBackend) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+
+	if b.password != "" {
+		if _, err = c.do("AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Redis authentication failed")
+		}
+	}
+	if b.db != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(b.db)); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "failed to select Redis database %d", b.db)
+		}
+	}
+	return c, nil
+}
+
+// do runs the command on an idle connection, or a new one if there aren't
+// any. Connections are only reused if the command didn't fail with a network
+// or protocol error.
+func (b *redisBackend) do(args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-b.idle:
+	default:
+		var err error
+		if c, err = b.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case b.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+func (b *redisBackend) Load(id string) ([]byte, error) {
+	reply, err := b.do("GET", b.prefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errSessionNotFound
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %v to GET", reply)
+	}
+	return data, nil
+}
+
+func (b *redisBackend) Store(id string, data []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := b.do("SET", b.prefix+id, string(data), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Update uses SET with XX, which only replaces keys that exist.
+func (b *redisBackend) Update(id string, data []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	reply, err := b.do("SET", b.prefix+id, string(data), "PX", strconv.FormatInt(ms, 10), "XX")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+func (b *redisBackend) Delete(id string) error {
+	_, err := b.do("DEL", b.prefix+id)
+	return err
+}
+
+// List scans for the session keys. Expired sessions have already been removed
+// by Redis.
+func (b *redisBackend) List() ([]string, error) {
+	ids := []string{}
+	cursor := "0"
+	for {
+		reply, err := b.do("SCAN", cursor, "MATCH", b.prefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("unexpected reply %v to SCAN", reply)
+		}
+		next, ok := items[0].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected cursor %v from SCAN", items[0])
+		}
+		keys, ok := items[1].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected keys %v from SCAN", items[1])
+		}
+
+		for _, k := range keys {
+			if key, ok := k.([]byte); ok && strings.HasPrefix(string(key), b.prefix) {
+				ids = append(ids, string(key[len(b.prefix):]))
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" {
+			return ids, nil
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   string
+	}{
+		{"simple string", "+OK\r\n", "OK", ""},
+		{"error", "-ERR unknown command\r\n", nil, "ERR unknown command"},
+		{"integer", ":42\r\n", int64(42), ""},
+		{"bulk string", "$5\r\nab\r\nc\r\n", []byte("ab\r\nc"), ""},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, ""},
+		{"null bulk string", "$-1\r\n", nil, ""},
+		{"array", "*3\r\n$1\r\na\r\n:1\r\n*1\r\n+b\r\n", []interface{}{[]byte("a"), int64(1), []interface{}{"b"}}, ""},
+		{"null array", "*-1\r\n", nil, ""},
+		{"no carriage return", "+OK\n", nil, "malformed reply"},
+		{"bad bulk string length", "$x\r\n", nil, "malformed bulk string length"},
+		{"bad array length", "*x\r\n", nil, "malformed array length"},
+		{"short bulk string", "$5\r\nab", nil, "unexpected EOF"},
+		{"unknown type", "?\r\n\r\n", nil, "unknown reply type"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &redisConn{r: bufio.NewReader(strings.NewReader(test.reply))}
+			got, err := c.readReply()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %#v, got %#v", test.want, got)
+			}
+		})
+	}
+}
+
+// testRedis is a stub Redis server that handles the commands that the
+// session backend uses.
+type testRedis struct {
+	net.Listener
+	password string
+
+	mutex    sync.Mutex
+	data     map[string]string
+	expires  map[string]time.Time
+	commands [][]string
+	conns    int
+}
+
+func newTestRedis(t *testing.T, password string) *testRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testRedis{
+		Listener: l,
+		password: password,
+		data:     map[string]string{},
+		expires:  map[string]time.Time{},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testRedis) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns++
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// readCommand reads an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	c := &redisConn{r: r}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("command was %#v", reply)
+	}
+	args := []string{}
+	for _, item := range items {
+		b, ok := item.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("argument was %#v", item)
+		}
+		args = append(args, string(b))
+	}
+	return args, nil
+}
+
+func (s *testRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.commands = append(s.commands, args)
+		cmd := strings.ToUpper(args[0])
+		var reply string
+		switch {
+		case cmd == "AUTH":
+			if args[1] == s.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			if !s.exists(args[1]) {
+				reply = "$-1\r\n"
+			} else {
+				v := s.data[args[1]]
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		case cmd == "SET" && len(args) > 5 && args[5] == "XX" && !s.exists(args[1]):
+			reply = "$-1\r\n"
+		case cmd == "SET":
+			ms, _ := strconv.Atoi(args[4])
+			s.data[args[1]] = args[2]
+			s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			reply = "+OK\r\n"
+		case cmd == "DEL":
+			_, ok := s.data[args[1]]
+			delete(s.data, args[1])
+			reply = ":0\r\n"
+			if ok {
+				reply = ":1\r\n"
+			}
+		case cmd == "SCAN":
+			reply = s.scan(args[1], strings.TrimSuffix(args[3], "*"))
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mutex.Unlock()
+
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// exists returns true if the key is set and hasn't expired. The mutex must be
+// held.
+func (s *testRedis) exists(key string) bool {
+	_, ok := s.data[key]
+	return ok && time.Now().Before(s.expires[key])
+}
+
+// scan returns one key per page, so that the cursor is followed. The cursor
+// is the index of the next key. The mutex must be held.
+func (s *testRedis) scan(cursor, prefix string) string {
+	keys := []string{}
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	i, _ := strconv.Atoi(cursor)
+	page := ""
+	n := 0
+	if i < len(keys) {
+		if strings.HasPrefix(keys[i], prefix) {
+			page = fmt.Sprintf("$%d\r\n%s\r\n", len(keys[i]), keys[i])
+			n = 1
+		}
+		i++
+	}
+	next := strconv.Itoa(i)
+	if i >= len(keys) {
+		next = "0"
+	}
+	return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n%s", len(next), next, n, page)
+}
+
+func TestRedisBackend(t *testing.T) {
+	s := newTestRedis(t, "secret")
+	defer s.Close()
+
+	b, err := newRedisBackend(s.Addr().String(), "secret", 2, "cas-proxy:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Store("s1", []byte("one\r\ntwo"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Store("s2", []byte("two"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	s.data["other:s3"] = "not a session"
+	s.expires["other:s3"] = time.Now().Add(time.Minute)
+	s.mutex.Unlock()
+
+	data, err := b.Load("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "one\r\ntwo" {
+		t.Errorf("expected the session data to round-trip, got %q", data)
+	}
+
+	if _, err = b.Load("missing"); err != errSessionNotFound {
+		t.Errorf("expected errSessionNotFound, got %v", err)
+	}
+
+	ids, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"s1", "s2"}) {
+		t.Errorf("expected sessions s1 and s2, got %v", ids)
+	}
+
+	if err = b.Update("s2", []byte("updated"), time.Minute); err != nil {
+		t.Errorf("expected a stored session to be updated, got %v", err)
+	}
+	if data, _ = b.Load("s2"); string(data) != "updated" {
+		t.Errorf("expected the updated session data, got %q", data)
+	}
+
+	if err = b.Delete("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Load("s1"); err != errSessionNotFound {
+		t.Errorf("expected a deleted session to be gone, got %v", err)
+	}
+	if err = b.Update("s1", []byte("revived"), time.Minute); err != errSessionNotFound {
+		t.Errorf("expected updating a deleted session to return errSessionNotFound, got %v", err)
+	}
+	if _, err = b.Load("s1"); err != errSessionNotFound {
+		t.Errorf("expected an update not to bring back a deleted session, got %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns != 1 {
+		t.Errorf("expected the connection to be reused, but %d were opened", s.conns)
+	}
+	want := [][]string{{"AUTH", "secret"}, {"SELECT", "2"}, {"PING"}}
+	if !reflect.DeepEqual(s.commands[:3], want) {
+		t.Errorf("expected the connection to start with %v, got %v", want, s.commands[:3])
+	}
+	if set := s.commands[3]; len(set) != 5 || set[0] != "SET" || set[1] != "cas-proxy:s1" || set[3] != "PX" || set[4] != "60000" {
+		t.Errorf("expected a SET with a TTL in milliseconds, got %v", set)
+	}
+}
+
+func TestRedisBackendErrors(t *testing.T) {
+	s := newTestRedis(t, "secret")
+	defer s.Close()
+
+	if _, err := newRedisBackend(s.Addr().String(), "wrong", 0, ""); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected a bad password to be an error, got %v", err)
+	}
+
+	// Error replies don't close the connection, but they're still errors.
+	b, err := newRedisBackend(s.Addr().String(), "secret", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.do("FLUSHALL"); err == nil {
+		t.Error("expected an error reply to be an error")
+	}
+	if _, ok := err.(redisError); !ok {
+		t.Errorf("expected a redisError, got %T", err)
+	}
+	if len(b.idle) != 1 {
+		t.Errorf("expected the connection to be kept after an error reply, got %d idle", len(b.idle))
+	}
+
+	s.Close()
+	if _, err = newRedisBackend(s.Addr().String(), "secret", 0, ""); err == nil {
+		t.Error("expected an unreachable server to be an error")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// requiresRenew returns true if requests for the path need a recent primary
+// login instead of one from an existing single sign-on session.
+func (c *CASProxy) requiresRenew(r *http.Request) bool {
+	return c.renewPaths.Match(r.URL.Path)
+}
+
+// isFresh returns true if the session's last renewed login happened within
+// the freshness window.
+func (c *CASProxy) isFresh(s *sessions.Session) bool {
+	renewed, ok := s.Values[sessionRenewed].(int64)
+	if !ok {
+		return false
+	}
+	return time.Since(time.Unix(renewed, 0)) <= c.renewMaxAge
+}
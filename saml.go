@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// casProtocolSAML11 selects ticket validation with SAML 1.1 assertions.
+const casProtocolSAML11 = "saml1.1"
+
+// samlTimeFormat is the format of the timestamps in SAML 1.1 requests.
+const samlTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// samlRequestTemplate is the SOAP-wrapped SAML 1.1 request that samlValidate
+// expects. The placeholders are the request ID, the issue instant, and the
+// escaped service ticket.
+const samlRequestTemplate = `<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/">` +
+	`<SOAP-ENV:Header/>` +
+	`<SOAP-ENV:Body>` +
+	`<samlp:Request xmlns:samlp="urn:oasis:names:tc:SAML:1.0:protocol" MajorVersion="1" MinorVersion="1" RequestID="%s" IssueInstant="%s">` +
+	`<samlp:AssertionArtifact>%s</samlp:AssertionArtifact>` +
+	`</samlp:Request>` +
+	`</SOAP-ENV:Body>` +
+	`</SOAP-ENV:Envelope>`
+
+// samlEnvelope is the SOAP envelope returned by samlValidate.
+type samlEnvelope struct {
+	XMLName  xml.Name     `xml:"Envelope"`
+	Response samlResponse `xml:"Body>Response"`
+}
+
+type samlResponse struct {
+	Status struct {
+		Code struct {
+			Value string `xml:"Value,attr"`
+		} `xml:"StatusCode"`
+		Message string `xml:"StatusMessage"`
+	} `xml:"Status"`
+	Assertion *samlAssertion `xml:"Assertion"`
+}
+
+type samlAssertion struct {
+	Conditions struct {
+		NotBefore    string   `xml:"NotBefore,attr"`
+		NotOnOrAfter string   `xml:"NotOnOrAfter,attr"`
+		Audiences    []string `xml:"AudienceRestrictionCondition>Audience"`
+	} `xml:"Conditions"`
+	AuthenticationStatement struct {
+		AuthenticationInstant string `xml:"AuthenticationInstant,attr"`
+		NameIdentifier        string `xml:"Subject>NameIdentifier"`
+	} `xml:"AuthenticationStatement"`
+	AttributeStatement struct {
+		NameIdentifier string          `xml:"Subject>NameIdentifier"`
+		Attributes     []samlAttribute `xml:"Attribute"`
+	} `xml:"AttributeStatement"`
+}
+
+type samlAttribute struct {
+	Name   string   `xml:"AttributeName,attr"`
+	Values []string `xml:"AttributeValue"`
+}
+
+// samlRequest returns the body of a samlValidate request for the ticket.
+func samlRequest(ticket string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	escaped := &bytes.Buffer{}
+	if err := xml.EscapeText(escaped, []byte(ticket)); err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf(
+		samlRequestTemplate,
+		"_"+hex.EncodeToString(id),
+		time.Now().UTC().Format(samlTimeFormat),
+		escaped.String(),
+	)), nil
+}
+
+// validateSAMLTicket validates the ticket by posting a SAML 1.1 request to
+// the samlValidate endpoint on the CAS server. samlValidate doesn't support
+// the renew parameter, so if renew is true the authentication instant in the
+// assertion has to be within the renewal window instead.
+func (a *CASAuthenticator) validateSAMLTicket(service, ticket string, renew bool) (*CASUser, error) {
+	casURL, err := url.Parse(a.casBase)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse CAS base URL %s", a.casBase)
+	}
+
+	// samlValidate takes the service in the TARGET parameter instead of the
+	// service parameter.
+	casURL.Path = path.Join(casURL.Path, a.casValidate)
+	q := casURL.Query()
+	q.Add("TARGET", service)
+	casURL.RawQuery = q.Encode()
+
+	body, err := samlRequest(ticket)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating SAML request")
+	}
+
+	resp, err := http.Post(casURL.String(), "text/xml", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "ticket validation error")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("ticket validation status code was %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading body of CAS response")
+	}
+
+	now := time.Now()
+	user, err := parseSAMLResponse(b, service, now, a.clockSkew)
+	if err != nil {
+		return nil, err
+	}
+
+	if renew {
+		if user.AuthenticatedAt.IsZero() {
+			return nil, errors.New("SAML assertion did not contain an authentication instant")
+		}
+		if now.Sub(user.AuthenticatedAt) > a.renewMaxAge+a.clockSkew {
+			return nil, fmt.Errorf("SAML assertion is for a login at %s, which is not recent enough", user.AuthenticatedAt.Format(time.RFC3339))
+		}
+	}
+
+	return user, nil
+}
+
+// parseSAMLResponse parses the SAML 1.1 response to a samlValidate request
+// and checks that its assertion is valid for the service at the given time,
+// allowing for the given amount of clock skew between the proxy and CAS.
+func parseSAMLResponse(b []byte, service string, now time.Time, skew time.Duration) (*CASUser, error) {
+	env := &samlEnvelope{}
+	if err := xml.Unmarshal(b, env); err != nil {
+		return nil, errors.Wrap(err, "error parsing SAML response")
+	}
+	sr := env.Response
+
+	// The status code value is a qualified name, and the prefix varies between
+	// CAS versions.
+	code := sr.Status.Code.Value
+	if i := strings.LastIndex(code, ":"); i >= 0 {
+		code = code[i+1:]
+	}
+	if code != "Success" {
+		return nil, fmt.Errorf("ticket validation failed with status %s: %s", sr.Status.Code.Value, strings.TrimSpace(sr.Status.Message))
+	}
+
+	a := sr.Assertion
+	if a == nil {
+		return nil, errors.New("SAML response did not contain an assertion")
+	}
+
+	if a.Conditions.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, a.Conditions.NotBefore)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse NotBefore %s", a.Conditions.NotBefore)
+		}
+		if now.Add(skew).Before(notBefore) {
+			return nil, fmt.Errorf("SAML assertion is not valid before %s", a.Conditions.NotBefore)
+		}
+	}
+
+	if a.Conditions.NotOnOrAfter != "" {
+		notOnOrAfter, err := time.Parse(time.RFC3339, a.Conditions.NotOnOrAfter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse NotOnOrAfter %s", a.Conditions.NotOnOrAfter)
+		}
+		if !now.Add(-skew).Before(notOnOrAfter) {
+			return nil, fmt.Errorf("SAML assertion is not valid on or after %s", a.Conditions.NotOnOrAfter)
+		}
+	}
+
+	if len(a.Conditions.Audiences) > 0 {
+		found := false
+		for _, audience := range a.Conditions.Audiences {
+			if strings.TrimSpace(audience) == service {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("SAML assertion is not intended for %s", service)
+		}
+	}
+
+	username := strings.TrimSpace(a.AuthenticationStatement.NameIdentifier)
+	if username == "" {
+		username = strings.TrimSpace(a.AttributeStatement.NameIdentifier)
+	}
+	if username == "" {
+		return nil, errors.New("SAML assertion did not contain a NameIdentifier")
+	}
+
+	attrs := map[string][]string{}
+	for _, attr := range a.AttributeStatement.Attributes {
+		for _, v := range attr.Values {
+			attrs[attr.Name] = append(attrs[attr.Name], strings.TrimSpace(v))
+		}
+	}
+
+	user := &CASUser{
+		Username:   username,
+		Attributes: attrs,
+	}
+
+	if a.AuthenticationStatement.AuthenticationInstant != "" {
+		instant, err := time.Parse(time.RFC3339, a.AuthenticationStatement.AuthenticationInstant)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse AuthenticationInstant %s", a.AuthenticationStatement.AuthenticationInstant)
+		}
+		user.AuthenticatedAt = instant
+	}
+
+	return user, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSAMLResponse returns a samlValidate response with the status code and
+// the assertion, which can be empty.
+func testSAMLResponse(status, assertion string) string {
+	return fmt.Sprintf(`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/">
+  <SOAP-ENV:Header/>
+  <SOAP-ENV:Body>
+    <Response xmlns="urn:oasis:names:tc:SAML:1.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:1.0:assertion" xmlns:samlp="urn:oasis:names:tc:SAML:1.0:protocol" IssueInstant="2019-01-01T12:00:00.000Z" MajorVersion="1" MinorVersion="1" Recipient="https://app.example.org/" ResponseID="R-1">
+      <Status>
+        <StatusCode Value="%s"/>
+        <StatusMessage>Ticket ST-1 not recognized</StatusMessage>
+      </Status>
+      %s
+    </Response>
+  </SOAP-ENV:Body>
+</SOAP-ENV:Envelope>`, status, assertion)
+}
+
+// testSAMLAssertion returns an assertion for alice that's valid from noon to
+// 12:01 on 2019-01-01 for the audience.
+func testSAMLAssertion(audience string) string {
+	return fmt.Sprintf(`<Assertion xmlns="urn:oasis:names:tc:SAML:1.0:assertion" AssertionID="A-1" IssueInstant="2019-01-01T12:00:00.000Z" Issuer="localhost" MajorVersion="1" MinorVersion="1">
+        <Conditions NotBefore="2019-01-01T12:00:00.000Z" NotOnOrAfter="2019-01-01T12:01:00.000Z">
+          <AudienceRestrictionCondition>
+            <Audience>%s</Audience>
+          </AudienceRestrictionCondition>
+        </Conditions>
+        <AttributeStatement>
+          <Subject><NameIdentifier>alice</NameIdentifier></Subject>
+          <Attribute AttributeName="memberOf" AttributeNamespace="http://www.ja-sig.org/products/cas/">
+            <AttributeValue>g1</AttributeValue>
+            <AttributeValue>g2</AttributeValue>
+          </Attribute>
+        </AttributeStatement>
+        <AuthenticationStatement AuthenticationInstant="2019-01-01T11:59:00.000Z" AuthenticationMethod="urn:oasis:names:tc:SAML:1.0:am:password">
+          <Subject><NameIdentifier>alice</NameIdentifier></Subject>
+        </AuthenticationStatement>
+      </Assertion>`, audience)
+}
+
+func TestParseSAMLResponse(t *testing.T) {
+	const service = "https://app.example.org/"
+	noon := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		body string
+		now  time.Time
+		user *CASUser
+		err  string
+	}{
+		{
+			name: "success",
+			body: testSAMLResponse("samlp:Success", testSAMLAssertion(service)),
+			now:  noon.Add(30 * time.Second),
+			user: &CASUser{
+				Username:        "alice",
+				Attributes:      map[string][]string{"memberOf": {"g1", "g2"}},
+				AuthenticatedAt: noon.Add(-time.Minute),
+			},
+		},
+		{
+			name: "unprefixed status",
+			body: testSAMLResponse("Success", testSAMLAssertion(service)),
+			now:  noon,
+			user: &CASUser{
+				Username:        "alice",
+				Attributes:      map[string][]string{"memberOf": {"g1", "g2"}},
+				AuthenticatedAt: noon.Add(-time.Minute),
+			},
+		},
+		{
+			name: "failure",
+			body: testSAMLResponse("samlp:RequestDenied", ""),
+			now:  noon,
+			err:  "ticket validation failed with status samlp:RequestDenied: Ticket ST-1 not recognized",
+		},
+		{
+			name: "no assertion",
+			body: testSAMLResponse("samlp:Success", ""),
+			now:  noon,
+			err:  "did not contain an assertion",
+		},
+		{
+			name: "not valid yet",
+			body: testSAMLResponse("samlp:Success", testSAMLAssertion(service)),
+			now:  noon.Add(-time.Minute),
+			err:  "not valid before",
+		},
+		{
+			name: "not valid yet within the skew",
+			body: testSAMLResponse("samlp:Success", testSAMLAssertion(service)),
+			now:  noon.Add(-10 * time.Second),
+			user: &CASUser{
+				Username:        "alice",
+				Attributes:      map[string][]string{"memberOf": {"g1", "g2"}},
+				AuthenticatedAt: noon.Add(-time.Minute),
+			},
+		},
+		{
+			name: "expired",
+			body: testSAMLResponse("samlp:Success", testSAMLAssertion(service)),
+			now:  noon.Add(2 * time.Minute),
+			err:  "not valid on or after",
+		},
+		{
+			name: "other audience",
+			body: testSAMLResponse("samlp:Success", testSAMLAssertion("https://other.example.org/")),
+			now:  noon,
+			err:  "not intended for " + service,
+		},
+		{
+			name: "not XML",
+			body: "yes\nalice\n",
+			now:  noon,
+			err:  "error parsing SAML response",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := parseSAMLResponse([]byte(test.body), service, test.now, 30*time.Second)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(user, test.user) {
+				t.Errorf("expected %+v, got %+v", test.user, user)
+			}
+		})
+	}
+}
+
+func TestSAMLRequest(t *testing.T) {
+	b, err := samlRequest("ST-1<&>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<samlp:AssertionArtifact>ST-1&lt;&amp;&gt;</samlp:AssertionArtifact>") {
+		t.Errorf("expected the ticket to be escaped, got %s", b)
+	}
+}
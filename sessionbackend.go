@@ -0,0 +1,504 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// ticketIndexInfo distinguishes the IDs that tickets are indexed under from
+// any other hash of the tickets.
+const ticketIndexInfo = "cas-proxy ticket index "
+
+// sessionForTicket is the value that holds the session ID in the entries that
+// index sessions by the tickets they were created from.
+const sessionForTicket = "proxy-session-for-ticket"
+
+// defaultSessionTTL is how long the server keeps a session that's stored
+// without a max age, such as one for a browser-session cookie.
+const defaultSessionTTL = 12 * time.Hour
+
+// errSessionNotFound is returned by a SessionBackend for session IDs that it
+// doesn't have, including ones that have expired.
+var errSessionNotFound = errors.New("session not found")
+
+// errSessionRevoked is returned when saving a session that was deleted from
+// the backend after it was loaded, which means it was logged out while the
+// request was being handled.
+var errSessionRevoked = errors.New("session was logged out")
+
+// SessionBackend stores encoded sessions on the server, keyed by session ID.
+// Implementations must be safe for concurrent use.
+type SessionBackend interface {
+	// Load returns the session data, or errSessionNotFound.
+	Load(id string) ([]byte, error)
+
+	// Store saves the session data, replacing anything stored for the ID. The
+	// session expires after the TTL.
+	Store(id string, data []byte, ttl time.Duration) error
+
+	// Update replaces the session data and TTL only if the session is still
+	// stored, and returns errSessionNotFound otherwise. Checking and replacing
+	// the session is atomic, so that a deleted session stays deleted.
+	Update(id string, data []byte, ttl time.Duration) error
+
+	// Delete removes the session. Deleting a missing session isn't an error.
+	Delete(id string) error
+
+	// List returns the IDs of the sessions that haven't expired.
+	List() ([]string, error)
+}
+
+// sessionRegenerator is implemented by session stores whose sessions have IDs
+// that should change when the user logs in. Cookie stores don't need it, since
+// the whole cookie is replaced.
+type sessionRegenerator interface {
+	Regenerate(session *sessions.Session) error
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validSessionID returns true if the ID could have come from newSessionID.
+// IDs are used in file names and keys, so anything else is rejected.
+func validSessionID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// serverStore is a sessions.Store that keeps sessions in a SessionBackend. The
+// cookie only contains the session ID, which is signed and encrypted with the
+// session keys so that it can't be forged.
+type serverStore struct {
+	backend    SessionBackend
+	cookies    *rotatingStore // Encodes the session ID cookie.
+	serializer securecookie.GobEncoder
+	Options    *sessions.Options
+}
+
+func newServerStore(backend SessionBackend, cookies *rotatingStore) *serverStore {
+	return &serverStore{
+		backend: backend,
+		cookies: cookies,
+		Options: cookies.Options,
+	}
+}
+
+// Get returns the session from the request's registry, loading it from the
+// backend the first time it's requested.
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session whose ID is in the cookie. A new, empty session is
+// returned if the cookie is missing or the session has expired, and also along
+// with the error if the cookie can't be decoded.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	stale, err := s.cookies.decode(name, c.Value, &id)
+	if err != nil {
+		return session, err
+	}
+	if !validSessionID(id) {
+		return session, errors.New("invalid session ID")
+	}
+
+	data, err := s.backend.Load(id)
+	if err == errSessionNotFound {
+		return session, nil
+	}
+	if err != nil {
+		return session, errors.Wrap(err, "failed to load session")
+	}
+
+	if err = s.serializer.Deserialize(data, &session.Values); err != nil {
+		return session, errors.Wrap(err, "failed to decode session")
+	}
+	if stale {
+		session.Values[reissueKey{}] = true
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Regenerate deletes the session from the backend and gives it a new ID, which
+// it's stored under when it's saved. It's called when a user logs in so that a
+// session ID known before the login can't be used afterwards.
+func (s *serverStore) Regenerate(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.backend.Delete(session.ID); err != nil {
+			return errors.Wrap(err, "failed to delete session")
+		}
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	session.ID = id
+	session.IsNew = true
+	return nil
+}
+
+// ticketIndexID returns the ID that the session created from the ticket is
+// indexed under in the backend. It looks like a session ID, so every backend
+// can store it, but no session has it.
+func ticketIndexID(ticket string) string {
+	sum := sha256.Sum256([]byte(ticketIndexInfo + ticket))
+	return hex.EncodeToString(sum[:])
+}
+
+// RevokeTicket deletes the session that was created from the ticket, and
+// returns false if there wasn't one.
+func (s *serverStore) RevokeTicket(ticket string) (bool, error) {
+	indexID := ticketIndexID(ticket)
+	values, err := s.load(indexID)
+	if err == errSessionNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if id, ok := values[sessionForTicket].(string); ok {
+		if err = s.backend.Delete(id); err != nil {
+			return false, errors.Wrap(err, "failed to delete session")
+		}
+	}
+	if err = s.backend.Delete(indexID); err != nil {
+		return false, errors.Wrap(err, "failed to delete ticket index entry")
+	}
+	return true, nil
+}
+
+// load returns the values of the session with the ID, for looking at sessions
+// outside of requests.
+func (s *serverStore) load(id string) (map[interface{}]interface{}, error) {
+	data, err := s.backend.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	values := map[interface{}]interface{}{}
+	if err = s.serializer.Deserialize(data, &values); err != nil {
+		return nil, errors.Wrap(err, "failed to decode session")
+	}
+	return values, nil
+}
+
+// Save stores the session in the backend and sets the cookie to its ID. A
+// negative max age deletes the session.
+//
+// Only sessions with new IDs are added to the backend. Sessions that were
+// loaded from it are only updated if they're still there, so that a request
+// that was in flight when the session was revoked can't bring it back. Those
+// sessions are logged out instead: the cookie is deleted and
+// errSessionRevoked is returned.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return errors.Wrap(err, "failed to delete session")
+			}
+		}
+		http.SetCookie(w, s.cookies.attrs.newCookie(r, session.Name(), "", session.Options))
+		return nil
+	}
+
+	delete(session.Values, reissueKey{})
+
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+		session.IsNew = true
+	}
+
+	data, err := s.serializer.Serialize(session.Values)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode session")
+	}
+
+	ttl := defaultSessionTTL
+	if session.Options.MaxAge > 0 {
+		ttl = time.Duration(session.Options.MaxAge) * time.Second
+	}
+	if session.IsNew {
+		err = s.backend.Store(session.ID, data, ttl)
+	} else {
+		err = s.backend.Update(session.ID, data, ttl)
+	}
+	if err == errSessionNotFound {
+		opts := *session.Options
+		opts.MaxAge = -1
+		http.SetCookie(w, s.cookies.attrs.newCookie(r, session.Name(), "", &opts))
+		return errSessionRevoked
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to store session")
+	}
+	session.IsNew = false
+
+	// Sessions are indexed by the ticket they were created from for as long
+	// as they last, so that any replica can revoke them when the provider
+	// reports a logout. The index entries don't have usernames, so they aren't
+	// listed as sessions.
+	if ticket, ok := session.Values[sessionTicket].(string); ok && ticket != "" {
+		index, err := s.serializer.Serialize(map[interface{}]interface{}{sessionForTicket: session.ID})
+		if err != nil {
+			return errors.Wrap(err, "failed to encode ticket index entry")
+		}
+		if err = s.backend.Store(ticketIndexID(ticket), index, ttl); err != nil {
+			return errors.Wrap(err, "failed to store ticket index entry")
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.cookies.encodingCodecs()...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, s.cookies.attrs.newCookie(r, session.Name(), encoded, session.Options))
+	return nil
+}
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// memoryBackend is a SessionBackend that keeps sessions in memory, so they
+// don't survive restarts and aren't shared between replicas.
+type memoryBackend struct {
+	mutex    sync.Mutex
+	sessions map[string]*memoryEntry
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		sessions: map[string]*memoryEntry{},
+	}
+}
+
+func (m *memoryBackend) Load(id string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.sessions[id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, errSessionNotFound
+	}
+	return entry.data, nil
+}
+
+func (m *memoryBackend) Store(id string, data []byte, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for k, v := range m.sessions {
+		if now.After(v.expires) {
+			delete(m.sessions, k)
+		}
+	}
+
+	m.sessions[id] = &memoryEntry{
+		data:    data,
+		expires: now.Add(ttl),
+	}
+	return nil
+}
+
+func (m *memoryBackend) Update(id string, data []byte, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.sessions[id]
+	if !ok || time.Now().After(entry.expires) {
+		return errSessionNotFound
+	}
+	m.sessions[id] = &memoryEntry{
+		data:    data,
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (m *memoryBackend) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memoryBackend) List() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	ids := []string{}
+	for k, v := range m.sessions {
+		if now.Before(v.expires) {
+			ids = append(ids, k)
+		}
+	}
+	return ids, nil
+}
+
+// fileBackend is a SessionBackend that keeps each session in a file named
+// after its ID. The file starts with the expiration time as a big-endian Unix
+// timestamp, followed by the session data. Replicas can share sessions by
+// sharing the directory.
+//
+// Updates and deletes are serialized within the process, but not between
+// replicas, so a session that another replica deletes while this one updates
+// it can come back.
+type fileBackend struct {
+	dir   string
+	mutex sync.Mutex // Held while updating or deleting sessions.
+}
+
+func newFileBackend(dir string) (*fileBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create session directory %s", dir)
+	}
+	return &fileBackend{dir: dir}, nil
+}
+
+func (f *fileBackend) path(id string) (string, error) {
+	if !validSessionID(id) {
+		return "", errors.New("invalid session ID")
+	}
+	return filepath.Join(f.dir, id), nil
+}
+
+func (f *fileBackend) Load(id string) ([]byte, error) {
+	p, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 8 || time.Now().Unix() >= int64(binary.BigEndian.Uint64(b)) {
+		os.Remove(p)
+		return nil, errSessionNotFound
+	}
+	return b[8:], nil
+}
+
+func (f *fileBackend) Store(id string, data []byte, ttl time.Duration) error {
+	p, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	return f.write(p, data, ttl)
+}
+
+func (f *fileBackend) Update(id string, data []byte, ttl time.Duration) error {
+	p, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, err = f.Load(id); err != nil {
+		return err
+	}
+	return f.write(p, data, ttl)
+}
+
+// write replaces the file at the path with the session data.
+func (f *fileBackend) write(p string, data []byte, ttl time.Duration) error {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(ttl).Unix()))
+	b = append(b, data...)
+
+	// Writing to a temporary file and renaming it means that readers never
+	// see a partially written session.
+	tmp, err := ioutil.TempFile(f.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *fileBackend) Delete(id string) error {
+	p, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the sessions that haven't expired, removing the files for the
+// ones that have.
+func (f *fileBackend) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, info := range infos {
+		if !validSessionID(info.Name()) {
+			continue
+		}
+		if _, err = f.Load(info.Name()); err == nil {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids, nil
+}
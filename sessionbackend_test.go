@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// newTestServerStore returns a serverStore with the backend, whose cookies
+// are encoded with a fixed key.
+func newTestServerStore(backend SessionBackend) *serverStore {
+	pairs := []keyPair{{hash: bytes.Repeat([]byte{1}, minHashKeySize)}}
+	cookies := newRotatingStore(pairs, &sessions.Options{Path: "/", MaxAge: 3600}, cookieAttributes{}, false)
+	return newServerStore(backend, cookies)
+}
+
+// requestWithCookies returns a request with the cookies set by the response.
+func requestWithCookies(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func testBackends(t *testing.T) (map[string]SessionBackend, func()) {
+	dir, err := ioutil.TempDir("", "cas-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := newFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := map[string]SessionBackend{
+		"memory": newMemoryBackend(),
+		"file":   files,
+	}
+	return backends, func() { os.RemoveAll(dir) }
+}
+
+func TestBackendUpdate(t *testing.T) {
+	backends, cleanup := testBackends(t)
+	defer cleanup()
+
+	id, err := newSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			if err := b.Update(id, []byte("new"), time.Minute); err != errSessionNotFound {
+				t.Errorf("expected updating a missing session to return errSessionNotFound, got %v", err)
+			}
+			if _, err := b.Load(id); err != errSessionNotFound {
+				t.Errorf("expected an update not to create a session, got %v", err)
+			}
+
+			if err := b.Store(id, []byte("stored"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Update(id, []byte("updated"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := b.Load(id); err != nil || string(data) != "updated" {
+				t.Errorf("expected the updated session, got %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestSaveRevokedSession(t *testing.T) {
+	backends, cleanup := testBackends(t)
+	defer cleanup()
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			store := newTestServerStore(b)
+
+			// Log in, which regenerates the session and stores it under its
+			// new ID.
+			login := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			session, err := store.Get(r, "proxy-session")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Regenerate(session); err != nil {
+				t.Fatal(err)
+			}
+			session.Values[sessionKey] = "alice"
+			if err = session.Save(r, login); err != nil {
+				t.Fatal(err)
+			}
+			id := session.ID
+
+			// A later request loads the session, and it's revoked before the
+			// request saves it.
+			r = requestWithCookies(login)
+			session, err = store.Get(r, "proxy-session")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.ID != id || session.Values[sessionKey] != "alice" {
+				t.Fatalf("expected the session for alice, got %s with %v", session.ID, session.Values)
+			}
+			if err = b.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			session.Values[sessionAccess] = time.Now().Unix()
+			if err = session.Save(r, w); err != errSessionRevoked {
+				t.Errorf("expected errSessionRevoked, got %v", err)
+			}
+			if _, err = b.Load(id); err != errSessionNotFound {
+				t.Errorf("expected the session to stay revoked, got %v", err)
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+				t.Errorf("expected the session cookie to be deleted, got %v", cookies)
+			}
+
+			// The old cookie doesn't load anything.
+			session, err = store.New(requestWithCookies(login), "proxy-session")
+			if err != nil || !session.IsNew || len(session.Values) != 0 {
+				t.Errorf("expected an empty session, got %v with %v", session.Values, err)
+			}
+		})
+	}
+}
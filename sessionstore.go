@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// maxCookieSize is the longest encoded session that's put in a cookie. Browsers
+// drop cookies much longer than this.
+const maxCookieSize = 4096
+
+// errCookieTooLarge is returned when a session doesn't fit in a cookie.
+var errCookieTooLarge = errors.New("the session is too large to fit in a cookie")
+
+// blockKeyInfo distinguishes the block keys derived from hash keys from any
+// other use of the hash keys.
+const blockKeyInfo = "cas-proxy session cookie encryption"
+
+// keyPair is a hash key for signing session cookies, along with an optional
+// block key for encrypting them.
+type keyPair struct {
+	hash  []byte
+	block []byte
+}
+
+// blockKey returns the AES key that cookies are encrypted with. If the pair
+// doesn't have a block key, a 256-bit key is derived from the hash key, so
+// cookies are always encrypted.
+func (p keyPair) blockKey() []byte {
+	if p.block != nil {
+		return p.block
+	}
+	mac := hmac.New(sha256.New, p.hash)
+	mac.Write([]byte(blockKeyInfo))
+	return mac.Sum(nil)
+}
+
+// reissueKey is the session key that marks sessions whose cookies were decoded
+// with an old key, so that they're saved with the newest one even if they
+// otherwise wouldn't be. It's removed before the session is encoded.
+type reissueKey struct{}
+
+// needsReissue returns true if the session's cookie was decoded with an old
+// key.
+func needsReissue(s *sessions.Session) bool {
+	_, ok := s.Values[reissueKey{}]
+	return ok
+}
+
+// rotatingStore is a sessions.Store that keeps sessions in cookies, like
+// sessions.CookieStore, but whose keys can be replaced while the proxy is
+// running. New cookies are always encoded with the first key pair, and the
+// rest are only used to decode cookies issued before the keys were rotated.
+// Those sessions are marked so that they're re-issued with the newest key on
+// the next response.
+//
+// Cookies are always encrypted. To migrate from the cookies issued before
+// that, which were only signed, the store can also accept signed-only cookies
+// until the keys are rotated for the first time.
+type rotatingStore struct {
+	mutex      sync.RWMutex
+	codecs     []securecookie.Codec
+	signedOnly []securecookie.Codec // Only decode cookies. Nil once the migration is over.
+	attrs      cookieAttributes
+	Options    *sessions.Options
+}
+
+func newRotatingStore(pairs []keyPair, opts *sessions.Options, attrs cookieAttributes, acceptSignedOnly bool) *rotatingStore {
+	s := &rotatingStore{
+		attrs:   attrs,
+		Options: opts,
+	}
+	s.codecs = codecsFromKeyPairs(pairs, true)
+	if acceptSignedOnly {
+		s.signedOnly = codecsFromKeyPairs(pairs, false)
+	}
+	return s
+}
+
+func codecsFromKeyPairs(pairs []keyPair, encrypted bool) []securecookie.Codec {
+	keys := [][]byte{}
+	for _, p := range pairs {
+		if encrypted {
+			keys = append(keys, p.hash, p.blockKey())
+		} else {
+			keys = append(keys, p.hash, nil)
+		}
+	}
+	codecs := securecookie.CodecsFromPairs(keys...)
+
+	// The length is checked by the store instead, so that sessions that are
+	// too large can be told apart from other encoding errors.
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxLength(0)
+		}
+	}
+	return codecs
+}
+
+// SetKeys replaces the key pairs, newest first. Signed-only cookies aren't
+// accepted afterwards, since rotating the keys ends the migration window.
+func (s *rotatingStore) SetKeys(pairs []keyPair) {
+	codecs := codecsFromKeyPairs(pairs, true)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.signedOnly != nil {
+		log.Info("signed-only session cookies are no longer accepted")
+	}
+	s.codecs = codecs
+	s.signedOnly = nil
+}
+
+// decodingCodecs returns the codecs that cookies can be decoded with.
+func (s *rotatingStore) decodingCodecs() []securecookie.Codec {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append(append([]securecookie.Codec{}, s.codecs...), s.signedOnly...)
+}
+
+// decode decodes the cookie value into dst with the first codec that accepts
+// it. It returns true if that wasn't the codec that new cookies are encoded
+// with.
+func (s *rotatingStore) decode(name, value string, dst interface{}) (bool, error) {
+	if len(value) > maxCookieSize {
+		return false, errCookieTooLarge
+	}
+
+	codecs := s.decodingCodecs()
+	errs := securecookie.MultiError{}
+	for i, codec := range codecs {
+		err := codec.Decode(name, value, dst)
+		if err == nil {
+			return i > 0, nil
+		}
+		errs = append(errs, err)
+	}
+	return false, errs
+}
+
+// encodingCodecs returns the codecs that cookies are encoded with. Only the
+// first one is used unless it fails.
+func (s *rotatingStore) encodingCodecs() []securecookie.Codec {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.codecs
+}
+
+// Get returns the session from the request's registry, decoding it from the
+// cookie the first time it's requested.
+func (s *rotatingStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New decodes the session from the cookie with any of the current keys. An
+// empty session is returned along with the error if it can't be decoded.
+func (s *rotatingStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	stale, err := s.decode(name, c.Value, &session.Values)
+	if err != nil {
+		return session, err
+	}
+	if stale {
+		session.Values[reissueKey{}] = true
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save encodes and encrypts the session with the newest keys and sets the
+// cookie. It returns errCookieTooLarge if the session doesn't fit.
+func (s *rotatingStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	delete(session.Values, reissueKey{})
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.encodingCodecs()...)
+	if err != nil {
+		return err
+	}
+	if len(encoded) > maxCookieSize {
+		return errCookieTooLarge
+	}
+	http.SetCookie(w, s.attrs.newCookie(r, session.Name(), encoded, session.Options))
+	return nil
+}
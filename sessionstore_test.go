@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// testKeyPair returns a key pair whose hash key is filled with b.
+func testKeyPair(b byte) keyPair {
+	return keyPair{hash: bytes.Repeat([]byte{b}, minHashKeySize)}
+}
+
+func newTestRotatingStore(pairs []keyPair, acceptSignedOnly bool) *rotatingStore {
+	opts := &sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+	return newRotatingStore(pairs, opts, cookieAttributes{secure: cookieSecureNever}, acceptSignedOnly)
+}
+
+// saveTestSession saves a session for alice with the store, and returns its
+// cookie.
+func saveTestSession(s *rotatingStore) (*http.Cookie, error) {
+	session := sessions.NewSession(s, "proxy-session")
+	session.Options = s.Options
+	session.Values[sessionKey] = "alice"
+	w := httptest.NewRecorder()
+	if err := s.Save(httptest.NewRequest(http.MethodGet, "/", nil), w, session); err != nil {
+		return nil, err
+	}
+	return w.Result().Cookies()[0], nil
+}
+
+// loadTestSession decodes the cookie with the store.
+func loadTestSession(s *rotatingStore, cookie *http.Cookie) (*sessions.Session, error) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	return s.New(r, cookie.Name)
+}
+
+func TestRotatingStore(t *testing.T) {
+	oldKey, newKey := testKeyPair(1), testKeyPair(2)
+	s := newTestRotatingStore([]keyPair{oldKey}, false)
+	old, err := saveTestSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := loadTestSession(s, old)
+	if err != nil || session.IsNew || session.Values[sessionKey] != "alice" || needsReissue(session) {
+		t.Fatalf("expected alice's session with the current key, got %v, %v", session.Values, err)
+	}
+
+	// Cookies are encrypted, so the session values can't be read from them.
+	if sc := securecookie.New(oldKey.hash, nil); sc.Decode(old.Name, old.Value, &map[interface{}]interface{}{}) == nil {
+		t.Error("expected the cookie to be encrypted")
+	}
+
+	// After rotating, cookies encoded with the previous key are still
+	// accepted, but are marked to be re-issued with the new one.
+	s.SetKeys([]keyPair{newKey, oldKey})
+	session, err = loadTestSession(s, old)
+	if err != nil || session.Values[sessionKey] != "alice" || !needsReissue(session) {
+		t.Fatalf("expected alice's session to be re-issued, got %v, %v", session.Values, err)
+	}
+	reissued, err := saveTestSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session, err = loadTestSession(newTestRotatingStore([]keyPair{newKey}, false), reissued); err != nil || needsReissue(session) {
+		t.Errorf("expected the re-issued cookie to use the new key, got %v", err)
+	}
+
+	// Once the old key is retired, its cookies are rejected.
+	s.SetKeys([]keyPair{newKey})
+	session, err = loadTestSession(s, old)
+	if err == nil || !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("expected a cookie with a retired key to be rejected, got %v, %v", session.Values, err)
+	}
+}
+
+func TestRotatingStoreSignedOnly(t *testing.T) {
+	pair := testKeyPair(1)
+	signed, err := securecookie.EncodeMulti("proxy-session", map[interface{}]interface{}{sessionKey: "alice"}, codecsFromKeyPairs([]keyPair{pair}, false)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := &http.Cookie{Name: "proxy-session", Value: signed}
+
+	// Signed-only cookies are rejected unless the migration is enabled.
+	if _, err = loadTestSession(newTestRotatingStore([]keyPair{pair}, false), cookie); err == nil {
+		t.Error("expected a signed-only cookie to be rejected by default")
+	}
+
+	// When they're accepted, they're re-issued encrypted.
+	s := newTestRotatingStore([]keyPair{pair}, true)
+	session, err := loadTestSession(s, cookie)
+	if err != nil || session.Values[sessionKey] != "alice" || !needsReissue(session) {
+		t.Fatalf("expected a signed-only cookie to be accepted and re-issued, got %v, %v", session.Values, err)
+	}
+	reissued, err := saveTestSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadTestSession(newTestRotatingStore([]keyPair{pair}, false), reissued); err != nil {
+		t.Errorf("expected the re-issued cookie to be encrypted, got %s", err)
+	}
+
+	// Rotating the keys ends the migration, even if the key stays the same.
+	s.SetKeys([]keyPair{pair})
+	if _, err = loadTestSession(s, cookie); err == nil {
+		t.Error("expected signed-only cookies to be rejected after the keys were rotated")
+	}
+}
+
+func TestRotatingStoreSetKeysConcurrently(t *testing.T) {
+	first, second := testKeyPair(1), testKeyPair(2)
+	s := newTestRotatingStore([]keyPair{first, second}, false)
+	cookie, err := saveTestSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests in flight keep working while the keys are swapped back and
+	// forth, since both keys are always accepted.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if session, err := loadTestSession(s, cookie); err != nil || session.Values[sessionKey] != "alice" {
+					t.Errorf("expected alice's session while the keys were swapped, got %v, %v", session.Values, err)
+					return
+				}
+				if _, err := saveTestSession(s); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			s.SetKeys([]keyPair{second, first})
+		} else {
+			s.SetKeys([]keyPair{first, second})
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRotatingStoreCookieSize(t *testing.T) {
+	s := newTestRotatingStore([]keyPair{testKeyPair(1)}, false)
+
+	session := sessions.NewSession(s, "proxy-session")
+	session.Options = s.Options
+	session.Values[sessionKey] = strings.Repeat("a", maxCookieSize)
+	if err := s.Save(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder(), session); err != errCookieTooLarge {
+		t.Errorf("expected errCookieTooLarge, got %v", err)
+	}
+
+	long := &http.Cookie{Name: "proxy-session", Value: strings.Repeat("a", maxCookieSize+1)}
+	if _, err := loadTestSession(s, long); err != errCookieTooLarge {
+		t.Errorf("expected errCookieTooLarge, got %v", err)
+	}
+}
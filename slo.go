@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// maxLogoutRequestSize is the largest request body that will be inspected for a
+// CAS logout request. Larger bodies are passed along to the backend untouched.
+const maxLogoutRequestSize = 64 * 1024
+
+// ticketIndexTTL is the minimum amount of time that a service ticket is
+// remembered after a session is created from it. It's longer than the lifetime
+// of a CAS ticket-granting ticket, so that a logout request can't arrive for a
+// ticket that has already been forgotten.
+const ticketIndexTTL = 24 * time.Hour
+
+// maxTicketIndexSize is the most tickets that the index remembers. Logout
+// requests don't need to be authenticated, so revocations of unknown tickets
+// stop being remembered when it's full, rather than letting anyone make it
+// grow.
+const maxTicketIndexSize = 100000
+
+type ticketEntry struct {
+	username string
+	issued   time.Time
+	revoked  bool
+}
+
+// ticketIndex keeps track of the provider logins, such as CAS service
+// tickets, that sessions were created from, so that sessions can be revoked
+// when the provider reports that the user logged out.
+type ticketIndex struct {
+	mutex   sync.RWMutex
+	ttl     time.Duration
+	tickets map[string]*ticketEntry
+}
+
+func newTicketIndex(ttl time.Duration) *ticketIndex {
+	if ttl < ticketIndexTTL {
+		ttl = ticketIndexTTL
+	}
+	return &ticketIndex{
+		ttl:     ttl,
+		tickets: map[string]*ticketEntry{},
+	}
+}
+
+// prune forgets the tickets that are older than the TTL. The mutex must be
+// held.
+func (t *ticketIndex) prune(now time.Time) {
+	for k, v := range t.tickets {
+		if now.Sub(v.issued) > t.ttl {
+			delete(t.tickets, k)
+		}
+	}
+}
+
+// Add records that a session was created for the user from the ticket. If the
+// index is full, the oldest ticket is forgotten to make room.
+func (t *ticketIndex) Add(ticket, username string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+	if len(t.tickets) >= maxTicketIndexSize {
+		oldest := ""
+		for k, v := range t.tickets {
+			if oldest == "" || v.issued.Before(t.tickets[oldest].issued) {
+				oldest = k
+			}
+		}
+		delete(t.tickets, oldest)
+	}
+
+	t.tickets[ticket] = &ticketEntry{
+		username: username,
+		issued:   now,
+	}
+}
+
+// Revoke marks the session created from the ticket as logged out. It returns
+// false if the ticket wasn't known, in which case it's remembered as revoked
+// anyway, unless the index is full.
+func (t *ticketIndex) Revoke(ticket string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, ok := t.tickets[ticket]
+	if ok {
+		entry.revoked = true
+		return true
+	}
+
+	now := time.Now()
+	t.prune(now)
+	if len(t.tickets) < maxTicketIndexSize {
+		t.tickets[ticket] = &ticketEntry{
+			issued:  now,
+			revoked: true,
+		}
+	}
+	return false
+}
+
+// IsRevoked returns true if the session created from the ticket was logged
+// out.
+func (t *ticketIndex) IsRevoked(ticket string) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	entry, ok := t.tickets[ticket]
+	return ok && entry.revoked
+}
+
+// samlLogoutRequest is the SAML document that CAS posts to services when a
+// user logs out.
+type samlLogoutRequest struct {
+	XMLName      xml.Name `xml:"LogoutRequest"`
+	SessionIndex string   `xml:"SessionIndex"`
+}
+
+// logoutRequest returns the value of the logoutRequest form field if the
+// request is a CAS back-channel logout request. The request body is restored
+// afterwards so that it can still be forwarded to the backend.
+func logoutRequest(r *http.Request) string {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+
+	if r.ContentLength > maxLogoutRequestSize {
+		return ""
+	}
+
+	// Put back whatever was read, followed by anything that wasn't.
+	body := r.Body
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxLogoutRequestSize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}
+	if err != nil || len(b) > maxLogoutRequestSize {
+		return ""
+	}
+
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return ""
+	}
+	return values.Get("logoutRequest")
+}
+
+// IsLogoutRequest implements the mux.Matcher interface so that CAS single
+// logout requests can be routed to the SingleLogout handler.
+func (a *CASAuthenticator) IsLogoutRequest(r *http.Request, m *mux.RouteMatch) bool {
+	return logoutRequest(r) != ""
+}
+
+// revokeTicket revokes the sessions created from the ticket. With a
+// server-side session backend, they're deleted from it as well, so that they're
+// revoked on every replica and after restarts. It returns false if the ticket
+// wasn't known.
+func (c *CASProxy) revokeTicket(ticket string) bool {
+	known := c.tickets.Revoke(ticket)
+	if s, ok := c.sessionStore.(*serverStore); ok {
+		deleted, err := s.RevokeTicket(ticket)
+		if err != nil {
+			log.Error(errors.Wrap(err, "failed to revoke the session in the session backend"))
+		}
+		known = known || deleted
+	}
+	return known
+}
+
+// SingleLogout returns a handler for the back-channel logout request that
+// CAS sends when a user logs out, revoking the session that was created from
+// the service ticket named in the request.
+func (a *CASAuthenticator) SingleLogout(p *CASProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lr := &samlLogoutRequest{}
+		if err := xml.Unmarshal([]byte(logoutRequest(r)), lr); err != nil {
+			err = errors.Wrap(err, "error parsing logout request")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ticket := strings.TrimSpace(lr.SessionIndex)
+		if ticket == "" {
+			http.Error(w, "logout request did not contain a session index", http.StatusBadRequest)
+			return
+		}
+
+		if p.revokeTicket(ticket) {
+			log.Infof("revoked the session for ticket %s", ticket)
+		} else {
+			log.Infof("received a logout request for unknown ticket %s", ticket)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
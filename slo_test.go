@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLogoutRequest = `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="LR-1" Version="2.0" IssueInstant="2019-01-01T00:00:00Z">
+  <saml:NameID>@NOT_USED@</saml:NameID>
+  <samlp:SessionIndex>ST-1</samlp:SessionIndex>
+</samlp:LogoutRequest>`
+
+func newLogoutPost(contentType, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func TestLogoutRequest(t *testing.T) {
+	form := url.Values{"logoutRequest": {testLogoutRequest}}.Encode()
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want string
+	}{
+		{"logout request", newLogoutPost("application/x-www-form-urlencoded", form), testLogoutRequest},
+		{"content type parameters", newLogoutPost("application/x-www-form-urlencoded; charset=utf-8", form), testLogoutRequest},
+		{"other form fields", newLogoutPost("application/x-www-form-urlencoded", "a=b"), ""},
+		{"JSON", newLogoutPost("application/json", form), ""},
+		{"GET", httptest.NewRequest(http.MethodGet, "/?"+form, nil), ""},
+		{"too large", newLogoutPost("application/x-www-form-urlencoded", form+"&pad="+strings.Repeat("x", maxLogoutRequestSize)), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := logoutRequest(test.req); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLogoutRequestRestoresBody(t *testing.T) {
+	form := url.Values{"logoutRequest": {testLogoutRequest}}.Encode()
+	r := newLogoutPost("application/x-www-form-urlencoded", form)
+	logoutRequest(r)
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != form {
+		t.Errorf("expected the body to be restored, got %q", b)
+	}
+}
+
+func TestSingleLogout(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		status  int
+		revoked bool
+	}{
+		{"known ticket", testLogoutRequest, http.StatusOK, true},
+		{"no session index", `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"/>`, http.StatusBadRequest, false},
+		{"not XML", "ST-1", http.StatusBadRequest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &CASProxy{tickets: newTicketIndex(0)}
+			p.tickets.Add("ST-1", "alice")
+
+			form := url.Values{"logoutRequest": {test.request}}.Encode()
+			w := httptest.NewRecorder()
+			(&CASAuthenticator{}).SingleLogout(p).ServeHTTP(w, newLogoutPost("application/x-www-form-urlencoded", form))
+
+			if w.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, w.Code)
+			}
+			if revoked := p.tickets.IsRevoked("ST-1"); revoked != test.revoked {
+				t.Errorf("expected revoked to be %t, got %t", test.revoked, revoked)
+			}
+		})
+	}
+}
+
+func TestTicketIndexPrune(t *testing.T) {
+	idx := newTicketIndex(0)
+	idx.Add("ST-old", "alice")
+	idx.Add("ST-new", "bob")
+	idx.tickets["ST-old"].issued = time.Now().Add(-2 * ticketIndexTTL)
+
+	// Unknown tickets are remembered as revoked, so that sessions created
+	// from them later are refused.
+	if idx.Revoke("ST-unknown") {
+		t.Error("expected an unknown ticket not to be known")
+	}
+	if !idx.IsRevoked("ST-unknown") {
+		t.Error("expected an unknown ticket to be remembered as revoked")
+	}
+
+	if _, ok := idx.tickets["ST-old"]; ok {
+		t.Error("expected an expired ticket to be pruned")
+	}
+	if _, ok := idx.tickets["ST-new"]; !ok {
+		t.Error("expected a current ticket to be kept")
+	}
+}
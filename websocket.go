@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// closePolicyViolation is the websocket close code for connections that are
+// closed because the user can't keep them open.
+const closePolicyViolation = 1008
+
+// closeFrameTimeout is how long to wait for the backend to finish sending a
+// frame before giving up on sending a close frame after it.
+const closeFrameTimeout = 5 * time.Second
+
+// maxHandshakeSize is the largest upgrade response from the backend that's
+// scanned for the start of the websocket frames.
+const maxHandshakeSize = 64 * 1024
+
+// maxRecheckFailures is how many rechecks in a row can fail to decide whether
+// the user can keep a connection open before it's closed anyway.
+const maxRecheckFailures = 3
+
+// errConnClosing is returned by writes that were cut short to close the
+// connection.
+var errConnClosing = errors.New("the websocket connection is being closed")
+
+// recheckError is returned by rechecks that couldn't decide whether the user
+// can keep the connection open, such as when the permissions service is down.
+// The connection is only closed if they keep failing.
+type recheckError struct {
+	error
+}
+
+// frameScanner follows the stream that the backend sends to the client, so
+// that the proxy knows when it can send a frame of its own without splitting
+// one of the backend's frames.
+type frameScanner struct {
+	handshake []byte // The upgrade response, until all of it has been seen.
+	upgraded  bool   // The backend accepted the upgrade, so frames follow.
+	failed    bool   // The stream isn't websocket frames.
+	header    []byte // The current frame's header, until all of it has been seen.
+	remaining uint64 // How much of the current frame's payload hasn't been seen.
+}
+
+// atBoundary returns true if the backend isn't in the middle of a frame.
+func (s *frameScanner) atBoundary() bool {
+	return s.upgraded && len(s.header) == 0 && s.remaining == 0
+}
+
+// frameHeaderLen returns how long the frame header that starts with h is, as
+// far as can be told from h.
+func frameHeaderLen(h []byte) int {
+	if len(h) < 2 {
+		return 2
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+// payloadLen returns the payload length in a complete frame header.
+func payloadLen(h []byte) uint64 {
+	switch h[1] & 0x7f {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(h[1] & 0x7f)
+	}
+}
+
+// scan follows the stream through p, and returns how much of it was scanned.
+// If stop is true, it stops at the first frame boundary.
+func (s *frameScanner) scan(p []byte, stop bool) int {
+	i := 0
+	for i < len(p) {
+		if stop && s.atBoundary() {
+			return i
+		}
+
+		switch {
+		case s.failed:
+			return len(p)
+
+		case !s.upgraded:
+			s.handshake = append(s.handshake, p[i])
+			i++
+			if bytes.HasSuffix(s.handshake, []byte("\r\n\r\n")) {
+				fields := bytes.Fields(s.handshake)
+				s.upgraded = len(fields) > 1 && string(fields[1]) == "101"
+				s.failed = !s.upgraded
+				s.handshake = nil
+			} else if len(s.handshake) > maxHandshakeSize {
+				s.failed = true
+				s.handshake = nil
+			}
+
+		case s.remaining > 0:
+			n := uint64(len(p) - i)
+			if n > s.remaining {
+				n = s.remaining
+			}
+			s.remaining -= n
+			i += int(n)
+
+		default:
+			s.header = append(s.header, p[i])
+			i++
+			if len(s.header) == frameHeaderLen(s.header) {
+				s.remaining = payloadLen(s.header)
+				s.header = s.header[:0]
+			}
+		}
+	}
+	return i
+}
+
+// closeFrame returns a close frame with the code and reason, which is
+// shortened to fit in a control frame.
+func closeFrame(code int, reason string) []byte {
+	if len(reason) > 123 {
+		reason = reason[:123]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+
+	frame := []byte{0x88, byte(2 + len(reason)), 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(code))
+	return append(frame, reason...)
+}
+
+// trackedConn is a hijacked websocket connection, along with who it belongs
+// to. It removes itself from the tracker when it's closed.
+type trackedConn struct {
+	net.Conn
+	tracker   *connTracker
+	sessionID string       // Empty if the request didn't use a server-side session.
+	username  string       // The user who opened the connection.
+	recheck   func() error // Returns an error if the user can't keep the connection open.
+	failures  int          // How many rechecks in a row have failed. Only used by Recheck.
+	expiry    *time.Timer  // Closes the connection when the identity expires. Nil if it doesn't.
+	once      sync.Once
+
+	writeMutex sync.Mutex
+	frames     frameScanner
+	closing    []byte // The close frame to send at the next frame boundary.
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(func() {
+		if t.expiry != nil {
+			t.expiry.Stop()
+		}
+		t.tracker.remove(t)
+	})
+	return t.Conn.Close()
+}
+
+// Write sends the backend's data to the client. If the connection is being
+// closed, the close frame is sent as soon as the backend's current frame is
+// done, and nothing after it is.
+func (t *trackedConn) Write(p []byte) (int, error) {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+
+	if t.closing == nil {
+		n, err := t.Conn.Write(p)
+		t.frames.scan(p[:n], false)
+		return n, err
+	}
+
+	n, err := t.Conn.Write(p[:t.frames.scan(p, true)])
+	if err != nil {
+		return n, err
+	}
+	if t.frames.atBoundary() {
+		t.sendClose()
+		return n, errConnClosing
+	}
+	return n, nil
+}
+
+// sendClose sends the close frame and closes the connection. The write mutex
+// must be held.
+func (t *trackedConn) sendClose() {
+	if _, err := t.Conn.Write(t.closing); err != nil {
+		log.Debug(errors.Wrap(err, "failed to send websocket close frame"))
+	}
+	t.Close()
+}
+
+// CloseWithReason sends the client a close frame with the code and reason
+// before closing the connection. If the backend is in the middle of sending a
+// frame, the close frame is sent after it. The connection is closed anyway if
+// that takes longer than closeFrameTimeout, which also covers clients that
+// aren't reading.
+func (t *trackedConn) CloseWithReason(code int, reason string) {
+	timer := time.AfterFunc(closeFrameTimeout, func() {
+		t.Close()
+	})
+
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+
+	if t.closing != nil {
+		timer.Stop()
+		return
+	}
+	t.closing = closeFrame(code, reason)
+
+	switch {
+	case t.frames.atBoundary():
+		t.sendClose()
+		timer.Stop()
+	case t.frames.failed:
+		t.Close()
+		timer.Stop()
+	}
+}
+
+// connTracker keeps track of the websocket connections that are open through
+// the proxy, so that they can be closed when their sessions are revoked or
+// their users lose access.
+type connTracker struct {
+	mutex sync.Mutex
+	conns map[*trackedConn]bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: map[*trackedConn]bool{},
+	}
+}
+
+func (t *connTracker) add(conn *trackedConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.conns[conn] = true
+}
+
+func (t *connTracker) remove(conn *trackedConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.conns, conn)
+}
+
+// matching returns the open connections that match.
+func (t *connTracker) matching(match func(*trackedConn) bool) []*trackedConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	conns := []*trackedConn{}
+	for conn := range t.conns {
+		if match(conn) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// closeMatching closes the open connections that match, and returns how many
+// there were. Closing the client's side of the connection ends the proxying,
+// which closes the backend's side as well.
+func (t *connTracker) closeMatching(reason string, match func(*trackedConn) bool) int {
+	conns := t.matching(match)
+	for _, conn := range conns {
+		conn.CloseWithReason(closePolicyViolation, reason)
+	}
+	return len(conns)
+}
+
+// CloseSession closes the connections opened with the server-side session.
+func (t *connTracker) CloseSession(sessionID string) int {
+	return t.closeMatching("session was revoked", func(conn *trackedConn) bool {
+		return conn.sessionID == sessionID
+	})
+}
+
+// CloseUser closes all of the user's connections, however they were opened.
+func (t *connTracker) CloseUser(username string) int {
+	return t.closeMatching("session was revoked", func(conn *trackedConn) bool {
+		return conn.username == username
+	})
+}
+
+// CountSession returns the number of connections open with the server-side
+// session.
+func (t *connTracker) CountSession(sessionID string) int {
+	return len(t.matching(func(conn *trackedConn) bool {
+		return conn.sessionID == sessionID
+	}))
+}
+
+// Recheck checks whether the users can still keep their connections open,
+// and closes the ones that they can't. The connections are checked at the
+// same time, so that a slow check doesn't hold up the rest. Checks that fail
+// to decide are logged, and the connection is only closed after
+// maxRecheckFailures of them in a row.
+func (t *connTracker) Recheck() {
+	conns := t.matching(func(conn *trackedConn) bool {
+		return conn.recheck != nil
+	})
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *trackedConn) {
+			defer wg.Done()
+			err := conn.recheck()
+			if err == nil {
+				conn.failures = 0
+				return
+			}
+
+			if _, ok := err.(*recheckError); ok {
+				conn.failures++
+				if conn.failures < maxRecheckFailures {
+					log.Warnf("failed to recheck websocket connection for %s (%d of %d): %s", conn.username, conn.failures, maxRecheckFailures, err)
+					return
+				}
+			}
+			log.Infof("closing websocket connection for %s: %s", conn.username, err)
+			conn.CloseWithReason(closePolicyViolation, err.Error())
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// watch rechecks the open connections at the interval.
+func (t *connTracker) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.Recheck()
+	}
+}
+
+// trackingWriter is an http.ResponseWriter that adds the connection to the
+// tracker when it's hijacked for a websocket.
+type trackingWriter struct {
+	http.ResponseWriter
+	tracker   *connTracker
+	sessionID string
+	username  string
+	expires   time.Time
+	recheck   func() error
+}
+
+// Track returns a ResponseWriter that tracks the connection if it's hijacked.
+// The connection is closed when the user's identity expires, unless expires
+// is zero. The recheck function is called periodically while the connection
+// is open, and the connection is closed if it returns an error. It can be nil.
+func (t *connTracker) Track(w http.ResponseWriter, sessionID, username string, expires time.Time, recheck func() error) http.ResponseWriter {
+	return &trackingWriter{
+		ResponseWriter: w,
+		tracker:        t,
+		sessionID:      sessionID,
+		username:       username,
+		expires:        expires,
+		recheck:        recheck,
+	}
+}
+
+func (w *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection can't be hijacked")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tc := &trackedConn{
+		Conn:      conn,
+		tracker:   w.tracker,
+		sessionID: w.sessionID,
+		username:  w.username,
+		recheck:   w.recheck,
+	}
+	w.tracker.add(tc)
+
+	if !w.expires.IsZero() {
+		tc.expiry = time.AfterFunc(time.Until(w.expires), func() {
+			log.Infof("closing websocket connection for %s: the token has expired", tc.username)
+			tc.CloseWithReason(closePolicyViolation, "token has expired")
+		})
+	}
+	return tc, rw, nil
+}
+
+// recheckWebsocket returns an error if the user can no longer make the
+// websocket request. An open websocket counts as activity, so sessions only
+// expire when they've been revoked or have outlived the maximum lifetime.
+// Sessions kept in cookies can't be revoked, so the values they had when the
+// websocket was opened are checked instead. Errors that don't decide whether
+// the user can keep the websocket are returned as *recheckErrors.
+func (c *CASProxy) recheckWebsocket(req *AccessRequest, sessionID string, values map[interface{}]interface{}) error {
+	if values != nil {
+		if store, ok := c.sessionStore.(*serverStore); ok && sessionID != "" {
+			var err error
+			values, err = store.load(sessionID)
+			if err == errSessionNotFound {
+				return errors.New("session was revoked or has expired")
+			}
+			if err != nil {
+				return &recheckError{errors.Wrap(err, "failed to load session")}
+			}
+		}
+
+		if ticket, ok := values[sessionTicket].(string); ok && c.tickets.IsRevoked(ticket) {
+			return errors.New("session was logged out")
+		}
+		if err := c.checkMaxLifetime(values, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	decision, err := c.authz.Authorize(req)
+	if err != nil {
+		return &recheckError{errors.Wrap(err, "failed to check access")}
+	}
+	if !decision.Allowed {
+		return errors.New("access denied: " + decision.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const testHandshake = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+
+// testFrame returns a binary frame with a payload of n bytes, which is masked
+// if masked is true.
+func testFrame(n int, masked bool) []byte {
+	frame := []byte{0x82}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	if masked {
+		frame = append(frame, 1, 2, 3, 4)
+	}
+	return append(frame, bytes.Repeat([]byte{'x'}, n)...)
+}
+
+func TestFrameScanner(t *testing.T) {
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	hs := []byte(testHandshake)
+
+	tests := []struct {
+		name     string
+		stream   []byte
+		boundary bool
+		failed   bool
+	}{
+		{"handshake", hs, true, false},
+		{"partial handshake", hs[:10], false, false},
+		{"rejected upgrade", []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"), false, true},
+		{"oversized handshake", []byte("HTTP/1.1 101 Switching Protocols\r\nX: " + strings.Repeat("x", maxHandshakeSize)), false, true},
+		{"frame", join(hs, testFrame(5, false)), true, false},
+		{"empty frame", join(hs, testFrame(0, false)), true, false},
+		{"partial header", join(hs, testFrame(5, false)[:1]), false, false},
+		{"partial payload", join(hs, testFrame(5, false)[:4]), false, false},
+		{"masked frame", join(hs, testFrame(5, true)), true, false},
+		{"masked frame without its key", join(hs, testFrame(5, true)[:4]), false, false},
+		{"16-bit length", join(hs, testFrame(300, false)), true, false},
+		{"16-bit length without its payload", join(hs, testFrame(300, false)[:4]), false, false},
+		{"64-bit length", join(hs, testFrame(70000, false)), true, false},
+		{"64-bit length partial payload", join(hs, testFrame(70000, false)[:1000]), false, false},
+		{"several frames", join(hs, testFrame(5, false), testFrame(300, true), testFrame(0, false)), true, false},
+	}
+
+	for _, test := range tests {
+		// The stream is scanned all at once and a byte at a time, since frame
+		// headers can be split across writes.
+		for _, chunk := range []int{len(test.stream), 1} {
+			s := &frameScanner{}
+			for i := 0; i < len(test.stream); i += chunk {
+				end := i + chunk
+				if end > len(test.stream) {
+					end = len(test.stream)
+				}
+				if n := s.scan(test.stream[i:end], false); n != end-i {
+					t.Fatalf("%s: expected to scan %d bytes, scanned %d", test.name, end-i, n)
+				}
+			}
+			if s.atBoundary() != test.boundary || s.failed != test.failed {
+				t.Errorf("%s in chunks of %d: expected boundary %t and failed %t, got %t and %t", test.name, chunk, test.boundary, test.failed, s.atBoundary(), s.failed)
+			}
+		}
+	}
+}
+
+func TestFrameScannerStop(t *testing.T) {
+	first := testFrame(5, false)
+	stream := append(append([]byte(testHandshake), first...), testFrame(5, false)...)
+
+	s := &frameScanner{}
+	n := s.scan(stream, true)
+	if n != len(testHandshake) {
+		t.Fatalf("expected to stop after the handshake at %d, stopped at %d", len(testHandshake), n)
+	}
+
+	// In the middle of a frame, scanning stops at its end.
+	s.scan(stream[n:n+3], false)
+	m := s.scan(stream[n+3:], true)
+	if m != len(first)-3 {
+		t.Errorf("expected to stop at the end of the frame after %d bytes, stopped after %d", len(first)-3, m)
+	}
+}
+
+func TestCloseFrame(t *testing.T) {
+	frame := closeFrame(closePolicyViolation, "access denied")
+	want := append([]byte{0x88, 15, 0x03, 0xf0}, "access denied"...)
+	if !bytes.Equal(frame, want) {
+		t.Errorf("expected %v, got %v", want, frame)
+	}
+
+	// Control frames can only have 125 bytes of payload, and the reason has to
+	// stay valid UTF-8 when it's cut short.
+	frame = closeFrame(closePolicyViolation, strings.Repeat("é", 100))
+	if len(frame) > 127 || int(frame[1]) != len(frame)-2 {
+		t.Errorf("expected a frame with at most 125 bytes of payload, got %d with a length of %d", len(frame)-2, frame[1])
+	}
+	if !utf8.Valid(frame[4:]) {
+		t.Errorf("expected the reason to be valid UTF-8, got %q", frame[4:])
+	}
+}
+
+func TestCloseWithReasonWaitsForFrame(t *testing.T) {
+	client, server := net.Pipe()
+	received := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		received <- b
+	}()
+
+	tracker := newConnTracker()
+	conn := &trackedConn{Conn: server, tracker: tracker, username: "alice"}
+	tracker.add(conn)
+
+	frame := testFrame(300, false)
+	if _, err := conn.Write(append([]byte(testHandshake), frame[:100]...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend is in the middle of a frame, so the close frame waits for
+	// the rest of it, and nothing after it is sent.
+	conn.CloseWithReason(closePolicyViolation, "access denied")
+	_, err := conn.Write(append(frame[100:], testFrame(5, false)...))
+	if err != errConnClosing {
+		t.Errorf("expected errConnClosing, got %v", err)
+	}
+
+	want := append(append([]byte(testHandshake), frame...), closeFrame(closePolicyViolation, "access denied")...)
+	if got := <-received; !bytes.Equal(got, want) {
+		t.Errorf("expected the frame followed by the close frame, got %d bytes ending in %q", len(got), got[len(got)-20:])
+	}
+	if n := len(tracker.matching(func(*trackedConn) bool { return true })); n != 0 {
+		t.Errorf("expected the closed connection to be untracked, got %d", n)
+	}
+}
+
+func TestRecheckFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		closes int // The recheck that closes the connection.
+	}{
+		{"denied", errors.New("access denied"), 1},
+		{"failed", &recheckError{errors.New("failed to check access")}, maxRecheckFailures},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go ioutil.ReadAll(client)
+			defer client.Close()
+
+			tracker := newConnTracker()
+			conn := &trackedConn{
+				Conn:    server,
+				tracker: tracker,
+				recheck: func() error { return test.err },
+			}
+			conn.frames.upgraded = true
+			tracker.add(conn)
+
+			for i := 1; i <= test.closes; i++ {
+				tracker.Recheck()
+				open := tracker.CountSession("") == 1
+				if open != (i < test.closes) {
+					t.Fatalf("expected the connection to be open after recheck %d to be %t", i, i < test.closes)
+				}
+			}
+		})
+	}
+}